@@ -3,6 +3,7 @@ package articles
 import (
 	"strconv"
 
+	"github.com/google/uuid"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
 	"gorm.io/gorm"
@@ -50,6 +51,23 @@ type CommentModel struct {
 	Author    ArticleUserModel
 	AuthorID  uint
 	Body      string `gorm:"type:text"`
+	UUID      string `gorm:"uniqueIndex"`
+}
+
+// BeforeCreate gives every new article the UUID exports and imports refer to it by
+func (article *ArticleModel) BeforeCreate(tx *gorm.DB) error {
+	if article.UUID == "" {
+		article.UUID = uuid.NewString()
+	}
+	return nil
+}
+
+// BeforeCreate gives every new comment the UUID exports and imports refer to it by
+func (comment *CommentModel) BeforeCreate(tx *gorm.DB) error {
+	if comment.UUID == "" {
+		comment.UUID = uuid.NewString()
+	}
+	return nil
 }
 
 func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
@@ -2,6 +2,7 @@ package articles
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/gosimple/slug"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
@@ -32,6 +33,13 @@ func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelVal
 	return articleModelValidator
 }
 
+// ValidateArticleModel checks an article that doesn't come from a request, e.g. an imported one,
+// against the same rules as ArticleModelValidator
+func ValidateArticleModel(articleModel ArticleModel) error {
+	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
+	return binding.Validator.ValidateStruct(&articleModelValidator)
+}
+
 func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 
@@ -59,6 +67,14 @@ func NewCommentModelValidator() CommentModelValidator {
 	return CommentModelValidator{}
 }
 
+// ValidateCommentModel checks a comment that doesn't come from a request against the same rules as
+// CommentModelValidator
+func ValidateCommentModel(commentModel CommentModel) error {
+	commentModelValidator := NewCommentModelValidator()
+	commentModelValidator.Comment.Body = commentModel.Body
+	return binding.Validator.ValidateStruct(&commentModelValidator)
+}
+
 func (s *CommentModelValidator) Bind(c *gin.Context) error {
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 
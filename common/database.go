@@ -6,14 +6,16 @@ import (
 	"os"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
-func Init() *gorm.DB {
-	dsn := fmt.Sprintf(
+// DSN builds the PostgreSQL connection string from the DB_* environment variables
+func DSN() string {
+	return fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=UTC",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_USER"),
@@ -21,6 +23,10 @@ func Init() *gorm.DB {
 		os.Getenv("DB_NAME"),
 		os.Getenv("DB_PORT"),
 	)
+}
+
+func Init() *gorm.DB {
+	dsn := DSN()
 
 	var db *gorm.DB
 	var err error
@@ -49,3 +55,31 @@ func Init() *gorm.DB {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// BackfillUUIDs gives the rows of model created before it had a UUID one, soft-deleted rows included.
+// Only rows still without a UUID are written, so instances migrating at the same time never overwrite
+// each other's, and updated_at is left alone so the rows don't look modified to exports.
+func BackfillUUIDs(db *gorm.DB, model interface{}) error {
+	missing := func() *gorm.DB {
+		return db.Unscoped().Model(model).Where("(uuid IS NULL OR uuid = '')")
+	}
+	if db.Dialector.Name() == "postgres" {
+		return missing().UpdateColumn("uuid", gorm.Expr("gen_random_uuid()::text")).Error
+	}
+
+	// Databases without gen_random_uuid() get them one row at a time
+	for {
+		var ids []uint
+		if err := missing().Limit(1000).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, id := range ids {
+			if err := missing().Where("id = ?", id).UpdateColumn("uuid", uuid.NewString()).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
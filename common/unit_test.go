@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestInitS3AndPresign(t *testing.T) {
@@ -80,3 +82,40 @@ func TestInitS3_LocalStack(t *testing.T) {
 	assert.True(t, isLocal, "LocalStack URL should point to localhost")
 	assert.Contains(t, url, "local-bucket")
 }
+
+func TestBackfillUUIDs(t *testing.T) {
+	type backfillModel struct {
+		gorm.Model
+		UUID string
+	}
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	assert.NoError(t, err)
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1) // One connection, so every query sees the same in-memory database
+	defer sqlDB.Close()
+	assert.NoError(t, db.AutoMigrate(&backfillModel{}))
+
+	rows := []backfillModel{{UUID: "kept"}, {}, {}}
+	assert.NoError(t, db.Create(&rows).Error)
+	assert.NoError(t, db.Delete(&rows[2]).Error)
+	var before backfillModel
+	assert.NoError(t, db.First(&before, rows[1].ID).Error)
+
+	assert.NoError(t, BackfillUUIDs(db, &backfillModel{}))
+
+	var after []backfillModel
+	assert.NoError(t, db.Unscoped().Order("id").Find(&after).Error)
+	assert.Len(t, after, 3)
+	assert.Equal(t, "kept", after[0].UUID)
+	assert.NotEmpty(t, after[1].UUID)
+	assert.NotEmpty(t, after[2].UUID, "soft-deleted rows get one too")
+	assert.NotEqual(t, after[1].UUID, after[2].UUID)
+	assert.Equal(t, before.UpdatedAt, after[1].UpdatedAt)
+
+	// Another instance migrating later leaves the UUIDs as they are
+	assert.NoError(t, BackfillUUIDs(db, &backfillModel{}))
+	var again []backfillModel
+	assert.NoError(t, db.Unscoped().Order("id").Find(&again).Error)
+	assert.Equal(t, after, again)
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// errNothingLeft is returned when resuming an import whose checkpoint is already at the end of the file
+var errNothingLeft = errors.New("nothing left to import after the checkpoint")
+
+// importSource is the stream an import parses. When resuming from a checkpoint it starts mid-file,
+// behind the few bytes the parser needs to pick up where it left off (the CSV header, the '[' of a
+// JSON array), and origin and line map offsets and line numbers in the stream back to the source file.
+type importSource struct {
+	io.Reader
+	origin int64
+	line   int      // Lines of the file before the stream's first one
+	record int      // Records read before the stream starts
+	format string   // csv, ndjson or json_array, set by the importer once known
+	header []string // CSV header, set by the importer
+
+	// errReport is the file rejected rows are written to, uploaded along with the checkpoints that
+	// count rows it got since reportedRows
+	errReport    string
+	reportedRows int
+	batch        int // Batches committed, by this attempt and the ones it resumes
+}
+
+func newImportSource(reader io.Reader) *importSource {
+	return &importSource{Reader: reader}
+}
+
+// resumeSource wraps body, the source file read from cp.Offset on, so the importer parses it as if
+// it had read the file from the start
+func resumeSource(body io.Reader, cp *jobs.ImportCheckpoint) (*importSource, error) {
+	src := &importSource{origin: cp.Offset, line: cp.Line, record: cp.Record, format: cp.Format, header: cp.Header, batch: cp.Batch}
+
+	if cp.Format == "csv" {
+		var prefix bytes.Buffer
+		w := csv.NewWriter(&prefix)
+		w.Write(cp.Header)
+		w.Flush()
+		src.Reader = io.MultiReader(&prefix, body)
+		src.origin -= int64(prefix.Len())
+		src.line--
+		return src, nil
+	}
+
+	// JSON: skip the whitespace after the last record, and for arrays the comma before the next one
+	reader := bufio.NewReader(body)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			if cp.Format == "ndjson" {
+				return nil, errNothingLeft
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' || b == '\n' || b == '\r' || b == '\t' {
+			src.origin++
+			if b == '\n' {
+				src.line++
+			}
+			continue
+		}
+		if b == ',' && cp.Format == "json_array" {
+			src.origin++
+			break
+		}
+		reader.UnreadByte()
+		break
+	}
+
+	if cp.Format == "json_array" {
+		src.Reader = io.MultiReader(strings.NewReader("["), reader)
+		src.origin--
+		return src, nil
+	}
+	src.Reader = reader
+	return src, nil
+}
+
+// checkpoint records that every record up to pos is committed.
+// It reaches the job row with the next progress flush and when the attempt ends, so a worker that
+// crashes replays at most jobs.ProgressFlushInterval worth of batches. A checkpoint counting rejected
+// rows the uploaded error report lacks is only taken once the report is uploaded again, along with
+// a flush; until then the previous one stays, so the attempt resuming from it finds every row it counts.
+func (s *importSource) checkpoint(job *jobs.Job, pos position) {
+	s.batch++
+	cp := &jobs.ImportCheckpoint{
+		Format:        s.format,
+		Header:        s.header,
+		Offset:        s.origin + pos.offset,
+		Record:        pos.record,
+		Line:          s.line + pos.line,
+		Batch:         s.batch,
+		ProcessedRows: job.ProcessedRows,
+		FailedRows:    job.FailedRows,
+		InsertedRows:  job.InsertedRows,
+		UpdatedRows:   job.UpdatedRows,
+		SkippedRows:   job.SkippedRows,
+	}
+	if s.errReport == "" || job.FailedRows <= s.reportedRows {
+		job.Checkpoint = cp
+	} else if progressDue(job) && uploadErrorReport(job, s.errReport) == nil {
+		s.reportedRows = job.FailedRows
+		job.Checkpoint = cp
+	}
+	reportProgress(job)
+}
+
+// restoreCounters puts the job's counters back to where they were at the checkpoint
+func restoreCounters(job *jobs.Job, cp *jobs.ImportCheckpoint) {
+	job.ProcessedRows, job.FailedRows = cp.ProcessedRows, cp.FailedRows
+	job.InsertedRows, job.UpdatedRows, job.SkippedRows = cp.InsertedRows, cp.UpdatedRows, cp.SkippedRows
+}
+
+// newOffsetScanner is a newLargeScanner that keeps *offset right after the last line it returned
+func newOffsetScanner(reader io.Reader, offset *int64) *bufio.Scanner {
+	scanner := newLargeScanner(reader)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		*offset += int64(advance)
+		return advance, token, err
+	})
+	return scanner
+}
+
+// seedErrorReport copies the first lines of the previous attempt's error report, the ones recorded
+// before the checkpoint, so a resumed import still reports every rejected row. The report was
+// uploaded along with the checkpoint, even if the previous attempt crashed.
+func seedErrorReport(key string, lines int, errFile io.Writer) {
+	reader, _, err := getStreamFromSource(key, 0)
+	if err != nil {
+		log.Printf("⚠️ Could not read previous error report %s: %v", key, err)
+		return
+	}
+	defer reader.Close()
+
+	scanner := newLargeScanner(reader)
+	for i := 0; i < lines && scanner.Scan(); i++ {
+		errFile.Write(scanner.Bytes())
+		errFile.Write([]byte("\n"))
+	}
+}
@@ -1,22 +1,176 @@
 package core
 
 import (
+	"context"
+	"database/sql"
 	"encoding/csv"
-	"encoding/json"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"gorm.io/gorm"
 )
 
-// StreamExport writes data from DB to the writer with filters
-func StreamExport(resource, format string, filters map[string]string, writer io.Writer) (int, error) {
-	db := common.GetDB()
+const (
+	// ExportProgressInterval is how many rows are written between two OnProgress calls
+	ExportProgressInterval = 1000
+
+	// ExportPageSize is how many rows are read, and have their expansions loaded, at a time
+	ExportPageSize = 500
+)
+
+// ExportOptions configures StreamExport
+type ExportOptions struct {
+	Format  string
+	Filter  string            // Filter expression, see ExportFilter
+	Filters map[string]string // Equality conditions by field, ANDed with Filter
+	Expand  []string          // Validated by jobs.ValidateExpand
+	Fields  []string          // Validated by ValidateFields, every field when empty
+
+	// Since, when set, exports only the rows created, updated or soft-deleted at that time or later,
+	// see ResolveSince. Records get a deleted_at field, and soft-deleted rows come as tombstones.
+	Since *time.Time
+
+	// DB is where rows are read from, such as a snapshot from BeginSnapshot, common.GetDB() when nil
+	DB *gorm.DB
+
+	// OnProgress, when set, is called with the number of rows written so far every ExportProgressInterval rows
+	OnProgress func(rows int)
+}
+
+// db is the database the export reads from
+func (opts ExportOptions) db() *gorm.DB {
+	if opts.DB != nil {
+		return opts.DB
+	}
+	return common.GetDB()
+}
+
+// BeginSnapshot starts the read-only REPEATABLE READ transaction an export reads from, so that
+// counting and streaming see the same data whatever is written meanwhile. It returns the time the
+// snapshot was taken at, by the database's clock. The caller ends the transaction with Rollback.
+func BeginSnapshot(db *gorm.DB) (*gorm.DB, time.Time, error) {
+	tx := db.Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return nil, time.Time{}, tx.Error
+	}
+	// Postgres takes the snapshot on the first statement of the transaction, not on BEGIN. Reading
+	// CURRENT_TIMESTAMP (the transaction's start time) is that statement, so the time comes from the
+	// same clock as the rows' timestamps, whatever the app server's clock says.
+	var now interface{}
+	if err := tx.Raw("SELECT CURRENT_TIMESTAMP").Row().Scan(&now); err != nil {
+		tx.Rollback()
+		return nil, time.Time{}, err
+	}
+	snapshotAt, err := databaseTime(now)
+	if err != nil {
+		tx.Rollback()
+		return nil, time.Time{}, err
+	}
+	return tx, snapshotAt, nil
+}
+
+// LimitSnapshot bounds how long a snapshot can be held: Postgres ends the session when the
+// transaction sits idle longer than idle, e.g. while waiting on a stalled client, or a statement
+// runs longer than statement. Other databases are left as they are.
+func LimitSnapshot(tx *gorm.DB, idle, statement time.Duration) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	if err := tx.Exec(fmt.Sprintf("SET LOCAL idle_in_transaction_session_timeout = %d", idle.Milliseconds())).Error; err != nil {
+		return err
+	}
+	return tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", statement.Milliseconds())).Error
+}
+
+// databaseTime reads a timestamp selected without a column type: a time.Time from Postgres, UTC text
+// from SQLite
+func databaseTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		return databaseTime(string(v))
+	case string:
+		return time.ParseInLocation(time.DateTime, v, time.UTC)
+	}
+	return time.Time{}, fmt.Errorf("unexpected timestamp %T from the database", v)
+}
+
+// exportedArticle is an article row along with its author's user
+type exportedArticle struct {
+	articles.ArticleModel
+	AuthorUUID     string
+	AuthorUsername string
+	AuthorBio      string
+	AuthorImage    *string
+}
+
+// exportedComment is a comment row along with the UUIDs of its article and its author's user
+type exportedComment struct {
+	articles.CommentModel
+	ArticleUUID string
+	AuthorUUID  string
+}
+
+// exportPage reads the records of the rows after the one with id after, at most ExportPageSize of
+// them, along with the id of the last one
+type exportPage func(after uint) (records []map[string]interface{}, last uint, err error)
+
+// csvValue formats a field for CSV, nil values (including nil pointers) as empty fields
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return *v
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// StreamExport writes data from DB to the writer with filters.
+// Records follow the resource's schema (see SchemaVersion), the one ProcessImport reads, plus the
+// expansions asked for, unless opts.Fields picks and orders their fields. Rows are read in pages,
+// in the order they were created.
+// It stops early with the context's cause when ctx is cancelled, returning the rows written so far.
+func StreamExport(ctx context.Context, resource string, opts ExportOptions, writer io.Writer) (int, error) {
+	db := opts.db()
+	format := opts.Format
 	count := 0
 
+	// Options are checked before the export starts, a bad one fails it for good
+	filter, err := ParseFilter(resource, opts.Filter, opts.Filters)
+	if err != nil {
+		return 0, jobs.Permanent(err)
+	}
+	fields, expand, err := parseFields(resource, format, opts.Expand, opts.Fields)
+	if err != nil {
+		return 0, jobs.Permanent(err)
+	}
+	if opts.Since != nil {
+		if !Incremental(resource) {
+			return 0, jobs.Permanent(fmt.Errorf("incremental exports are only supported for articles and comments"))
+		}
+		fields = append(fields, exportField{name: "deleted_at", as: "deleted_at"})
+	}
+
+	var page exportPage
+	switch resource {
+	case "users":
+		page = userPages(db, filter)
+	case "articles":
+		page = articlePages(db, filter, opts.Since, expand, format == "csv")
+	case "comments":
+		page = commentPages(db, filter, opts.Since)
+	}
+
 	// CSV Writer setup
 	var csvWriter *csv.Writer
 	if format == "csv" {
@@ -29,131 +183,280 @@ func StreamExport(resource, format string, filters map[string]string, writer io.
 		writer.Write([]byte("["))
 	}
 
-	encoder := json.NewEncoder(writer)
-
 	// Helper to write a record
-	writeRecord := func(data map[string]interface{}, csvHeaders []string) error {
+	writeRecord := func(data map[string]interface{}) error {
+		if opts.OnProgress != nil && count > 0 && count%ExportProgressInterval == 0 {
+			opts.OnProgress(count)
+		}
 		if format == "csv" {
 			if count == 0 {
-				if err := csvWriter.Write(csvHeaders); err != nil {
+				var headers []string
+				for _, f := range fields {
+					headers = append(headers, f.as)
+				}
+				if err := csvWriter.Write(headers); err != nil {
 					return err
 				}
 			}
 			var row []string
-			for _, h := range csvHeaders {
-				val := ""
-				if v, ok := data[h]; ok && v != nil {
-					val = fmt.Sprintf("%v", v)
-				}
-				row = append(row, val)
+			for _, f := range fields {
+				row = append(row, csvValue(data[f.name]))
 			}
 			return csvWriter.Write(row)
 		} else if format == "json" {
 			if count > 0 {
 				writer.Write([]byte(","))
 			}
-			return encoder.Encode(data)
+			return writeJSONRecord(writer, data, fields)
 		} else {
-			return encoder.Encode(data)
+			return writeJSONRecord(writer, data, fields)
 		}
 	}
 
-	switch resource {
-	case "users":
-		query := db.Model(&users.UserModel{})
-		// Apply User Filters
-		if username, ok := filters["username"]; ok && username != "" {
-			query = query.Where("username = ?", username)
+	var after uint
+	for {
+		if err := cancelled(ctx); err != nil {
+			return count, err
 		}
-
-		rows, err := query.Rows()
+		records, last, err := page(after)
 		if err != nil {
-			return 0, err
+			return count, err
 		}
-		defer rows.Close()
-
-		headers := []string{"id", "username", "email", "bio", "image"}
-		for rows.Next() {
-			var u users.UserModel
-			db.ScanRows(rows, &u)
-			data := map[string]interface{}{
-				"id": u.UUID, "username": u.Username, "email": u.Email, "bio": u.Bio, "image": u.Image,
+		for _, data := range records {
+			if err := cancelled(ctx); err != nil {
+				return count, err
 			}
-			if err := writeRecord(data, headers); err != nil {
+			if err := writeRecord(data); err != nil {
 				return count, err
 			}
 			count++
 		}
+		if len(records) < ExportPageSize {
+			break
+		}
+		after = last
+	}
 
+	if format == "json" {
+		writer.Write([]byte("]"))
+	}
+	return count, nil
+}
+
+// CountExport counts the rows StreamExport exports with the same options
+func CountExport(resource string, opts ExportOptions) (int64, error) {
+	filter, err := ParseFilter(resource, opts.Filter, opts.Filters)
+	if err != nil {
+		return 0, jobs.Permanent(err)
+	}
+	db := opts.db()
+	var query *gorm.DB
+	switch resource {
+	case "users":
+		query = db.Model(&users.UserModel{})
 	case "articles":
-		query := db.Model(&articles.ArticleModel{})
-		// Apply Article Filters
-		if author, ok := filters["author"]; ok && author != "" {
-			// Join to find author ID by username
-			var user users.UserModel
-			if err := db.Where("username = ?", author).First(&user).Error; err == nil {
-				query = query.Where("author_id = ?", user.ID)
-			}
+		query = changedSince(db.Model(&articles.ArticleModel{}), "article_models", opts.Since)
+	case "comments":
+		query = changedSince(db.Model(&articles.CommentModel{}), "comment_models", opts.Since)
+	}
+	var count int64
+	err = filter.apply(query).Count(&count).Error
+	return count, err
+}
+
+func userPages(db *gorm.DB, filter *ExportFilter) exportPage {
+	query := filter.apply(db.Model(&users.UserModel{})).Session(&gorm.Session{})
+
+	return func(after uint) ([]map[string]interface{}, uint, error) {
+		var rows []users.UserModel
+		if err := query.Where("id > ?", after).Order("id").Limit(ExportPageSize).Find(&rows).Error; err != nil {
+			return nil, 0, err
 		}
-		if slug, ok := filters["slug"]; ok && slug != "" {
-			query = query.Where("slug = ?", slug)
+		records := make([]map[string]interface{}, len(rows))
+		var last uint
+		for i, u := range rows {
+			records[i] = map[string]interface{}{
+				"id": u.UUID, "username": u.Username, "email": u.Email, "bio": u.Bio, "image": u.Image,
+				"schema_version": SchemaVersion,
+			}
+			last = u.ID
 		}
+		return records, last, nil
+	}
+}
 
-		rows, err := query.Rows()
-		if err != nil {
-			return 0, err
-		}
-		defer rows.Close()
+// articlesQuery selects articles along with their author's user
+func articlesQuery(db *gorm.DB) *gorm.DB {
+	return db.Model(&articles.ArticleModel{}).
+		Select("article_models.*, user_models.uuid AS author_uuid, user_models.username AS author_username, " +
+			"user_models.bio AS author_bio, user_models.image AS author_image").
+		Joins("LEFT JOIN article_user_models ON article_user_models.id = article_models.author_id").
+		Joins("LEFT JOIN user_models ON user_models.id = article_user_models.user_model_id")
+}
 
-		headers := []string{"id", "slug", "title", "description", "body", "created_at", "updated_at", "author_id"}
-		for rows.Next() {
-			var a articles.ArticleModel
-			db.ScanRows(rows, &a)
-			data := map[string]interface{}{
+// articlePages reads pages of articles with the expansions asked for, flattened to CSV columns
+// when flat is set. With since, only the articles changed since then are read.
+func articlePages(db *gorm.DB, filter *ExportFilter, since *time.Time, expand []string, flat bool) exportPage {
+	// Authors are exported as the UUID of their user, the way imports refer to them
+	query := filter.apply(changedSince(articlesQuery(db), "article_models", since)).Session(&gorm.Session{})
+
+	return func(after uint) ([]map[string]interface{}, uint, error) {
+		var rows []exportedArticle
+		if err := query.Where("article_models.id > ?", after).Order("article_models.id").Limit(ExportPageSize).Find(&rows).Error; err != nil {
+			return nil, 0, err
+		}
+		records := make([]map[string]interface{}, len(rows))
+		var last uint
+		for i, a := range rows {
+			records[i] = map[string]interface{}{
 				"id": a.UUID, "slug": a.Slug, "title": a.Title, "description": a.Description,
-				"body": a.Body, "created_at": a.CreatedAt.Format(time.RFC3339), "updated_at": a.UpdatedAt.Format(time.RFC3339), "author_id": a.AuthorID,
+				"body": a.Body, "created_at": a.CreatedAt.Format(time.RFC3339), "updated_at": a.UpdatedAt.Format(time.RFC3339), "author_id": a.AuthorUUID,
+				"schema_version": SchemaVersion,
 			}
-			if err := writeRecord(data, headers); err != nil {
-				return count, err
+			last = a.ID
+		}
+		if err := expandArticles(db, rows, records, expand, flat); err != nil {
+			return nil, 0, err
+		}
+		for i, a := range rows {
+			if a.DeletedAt.Valid {
+				records[i] = tombstone(a.UUID, a.DeletedAt.Time)
 			}
-			count++
 		}
+		return records, last, nil
+	}
+}
 
-	case "comments":
-		query := db.Model(&articles.CommentModel{})
-		// Apply Comment Filters
-		if articleSlug, ok := filters["article"]; ok && articleSlug != "" {
-			var art articles.ArticleModel
-			if err := db.Where("slug = ?", articleSlug).First(&art).Error; err == nil {
-				query = query.Where("article_id = ?", art.ID)
+// expandArticles adds the related data expand asks for to the records of a page of articles, with
+// one query per expansion for the whole page. Tags go in tagList, the way imports read them.
+// When flat is set, nested data is flattened into the CSV fields of expansionFields.
+func expandArticles(db *gorm.DB, rows []exportedArticle, records []map[string]interface{}, expand []string, flat bool) error {
+	if len(rows) == 0 || len(expand) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(rows))
+	for i, a := range rows {
+		ids[i] = a.ID
+	}
+
+	for _, name := range expand {
+		switch name {
+		case jobs.ExpandTags:
+			var tags []struct {
+				ArticleModelID uint
+				Tag            string
+			}
+			if err := db.Table("article_tags").
+				Select("article_tags.article_model_id, tag_models.tag").
+				Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+				Where("article_tags.article_model_id IN ?", ids).
+				Order("tag_models.tag").
+				Scan(&tags).Error; err != nil {
+				return fmt.Errorf("failed to load tags: %w", err)
+			}
+			byArticle := make(map[uint][]string)
+			for _, t := range tags {
+				byArticle[t.ArticleModelID] = append(byArticle[t.ArticleModelID], t.Tag)
+			}
+			for i, a := range rows {
+				tagList := byArticle[a.ID]
+				if flat {
+					records[i]["tagList"] = joinTags(tagList)
+				} else if tagList == nil {
+					records[i]["tagList"] = []string{}
+				} else {
+					records[i]["tagList"] = tagList
+				}
 			}
-		}
 
-		rows, err := query.Rows()
-		if err != nil {
-			return 0, err
-		}
-		defer rows.Close()
+		case jobs.ExpandAuthor:
+			// The author's user is joined to the page already
+			for i, a := range rows {
+				if flat {
+					records[i]["author_username"], records[i]["author_bio"], records[i]["author_image"] = a.AuthorUsername, a.AuthorBio, a.AuthorImage
+				} else {
+					records[i]["author"] = map[string]interface{}{
+						"id": a.AuthorUUID, "username": a.AuthorUsername, "bio": a.AuthorBio, "image": a.AuthorImage,
+					}
+				}
+			}
 
-		headers := []string{"id", "body", "article_id", "author_id", "created_at"}
-		for rows.Next() {
-			var c articles.CommentModel
-			db.ScanRows(rows, &c)
-			data := map[string]interface{}{
-				"id": c.ID, "body": c.Body, "article_id": c.ArticleID, "author_id": c.AuthorID, "created_at": c.CreatedAt.Format(time.RFC3339),
+		case jobs.ExpandComments:
+			var comments []exportedComment
+			if err := commentsQuery(db).
+				Where("comment_models.article_id IN ?", ids).
+				Order("comment_models.id").
+				Find(&comments).Error; err != nil {
+				return fmt.Errorf("failed to load comments: %w", err)
 			}
-			if err := writeRecord(data, headers); err != nil {
-				return count, err
+			byArticle := make(map[uint][]map[string]interface{})
+			for _, c := range comments {
+				byArticle[c.ArticleID] = append(byArticle[c.ArticleID], map[string]interface{}{
+					"id": c.UUID, "body": c.Body, "author_id": c.AuthorUUID, "created_at": c.CreatedAt.Format(time.RFC3339),
+				})
+			}
+			for i, a := range rows {
+				records[i]["comments_count"] = len(byArticle[a.ID])
+				if !flat {
+					records[i]["comments"] = append([]map[string]interface{}{}, byArticle[a.ID]...)
+				}
 			}
-			count++
-		}
 
-	default:
-		return 0, fmt.Errorf("unknown resource: %s", resource)
+		case jobs.ExpandFavoritesCount:
+			var counts []struct {
+				FavoriteID uint
+				Count      uint
+			}
+			if err := db.Model(&articles.FavoriteModel{}).
+				Select("favorite_id, COUNT(*) AS count").
+				Where("favorite_id IN ?", ids).
+				Group("favorite_id").
+				Scan(&counts).Error; err != nil {
+				return fmt.Errorf("failed to load favorites counts: %w", err)
+			}
+			byArticle := make(map[uint]uint)
+			for _, c := range counts {
+				byArticle[c.FavoriteID] = c.Count
+			}
+			for i, a := range rows {
+				records[i]["favorites_count"] = byArticle[a.ID]
+			}
+		}
 	}
+	return nil
+}
 
-	if format == "json" {
-		writer.Write([]byte("]"))
+// commentsQuery selects comments along with the UUIDs of their article and their author's user
+func commentsQuery(db *gorm.DB) *gorm.DB {
+	return db.Model(&articles.CommentModel{}).
+		Select("comment_models.*, article_models.uuid AS article_uuid, user_models.uuid AS author_uuid").
+		Joins("LEFT JOIN article_models ON article_models.id = comment_models.article_id").
+		Joins("LEFT JOIN article_user_models ON article_user_models.id = comment_models.author_id").
+		Joins("LEFT JOIN user_models ON user_models.id = article_user_models.user_model_id")
+}
+
+// commentPages reads pages of comments, only the ones changed since then with since
+func commentPages(db *gorm.DB, filter *ExportFilter, since *time.Time) exportPage {
+	// Comments, their article and their author are exported by UUID, the way imports refer to them
+	query := filter.apply(changedSince(commentsQuery(db), "comment_models", since)).Session(&gorm.Session{})
+
+	return func(after uint) ([]map[string]interface{}, uint, error) {
+		var rows []exportedComment
+		if err := query.Where("comment_models.id > ?", after).Order("comment_models.id").Limit(ExportPageSize).Find(&rows).Error; err != nil {
+			return nil, 0, err
+		}
+		records := make([]map[string]interface{}, len(rows))
+		var last uint
+		for i, c := range rows {
+			records[i] = map[string]interface{}{
+				"id": c.UUID, "body": c.Body, "article_id": c.ArticleUUID, "author_id": c.AuthorUUID, "created_at": c.CreatedAt.Format(time.RFC3339),
+				"schema_version": SchemaVersion,
+			}
+			if c.DeletedAt.Valid {
+				records[i] = tombstone(c.UUID, c.DeletedAt.Time)
+			}
+			last = c.ID
+		}
+		return records, last, nil
 	}
-	return count, nil
 }
@@ -0,0 +1,448 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// ExportFilter selects the rows of an export. It is parsed from an expression such as
+//
+//	tag IN (go, web) AND (author = john OR favorited = john) AND created_at >= 2026-01-01 AND NOT title CONTAINS draft
+//
+// Conditions compare a field with =, !=, <, <=, >, >=, IN (list) or CONTAINS (case-insensitive), and
+// combine with AND, OR, NOT and parentheses; AND binds tighter than OR. Keywords are case-insensitive.
+// Values are bare words or "double-quoted" strings. Timestamps are RFC3339, or dates standing for
+// the whole UTC day.
+type ExportFilter struct {
+	sql  string
+	args []interface{}
+}
+
+// filterField is a field an export can be filtered on. The condition applies to column, inside
+// subquery when the field belongs to related rows.
+type filterField struct {
+	column   string
+	time     bool
+	subquery string // Format with the condition on column, for fields of related rows
+}
+
+// Subqueries of the fields of related rows
+const (
+	authorSubquery = "%s IN (SELECT article_user_models.id FROM article_user_models " +
+		"JOIN user_models ON user_models.id = article_user_models.user_model_id WHERE %s)"
+	tagSubquery = "article_models.id IN (SELECT article_tags.article_model_id FROM article_tags " +
+		"JOIN tag_models ON tag_models.id = article_tags.tag_model_id WHERE %s)"
+	favoritedSubquery = "article_models.id IN (SELECT favorite_models.favorite_id FROM favorite_models " +
+		"JOIN article_user_models ON article_user_models.id = favorite_models.favorite_by_id " +
+		"JOIN user_models ON user_models.id = article_user_models.user_model_id WHERE favorite_models.deleted_at IS NULL AND %s)"
+	articleSubquery = "comment_models.article_id IN (SELECT article_models.id FROM article_models WHERE %s)"
+)
+
+// filterFields are the fields each resource can be filtered on
+var filterFields = map[string]map[string]filterField{
+	"users": {
+		"id":       {column: "user_models.uuid"},
+		"username": {column: "user_models.username"},
+		"email":    {column: "user_models.email"},
+		"bio":      {column: "user_models.bio"},
+	},
+	"articles": {
+		"id":          {column: "article_models.uuid"},
+		"slug":        {column: "article_models.slug"},
+		"title":       {column: "article_models.title"},
+		"description": {column: "article_models.description"},
+		"body":        {column: "article_models.body"},
+		"created_at":  {column: "article_models.created_at", time: true},
+		"updated_at":  {column: "article_models.updated_at", time: true},
+		"author":      {column: "user_models.username", subquery: fmt.Sprintf(authorSubquery, "article_models.author_id", "%s")},
+		"author_id":   {column: "user_models.uuid", subquery: fmt.Sprintf(authorSubquery, "article_models.author_id", "%s")},
+		"tag":         {column: "tag_models.tag", subquery: tagSubquery},
+		"favorited":   {column: "user_models.username", subquery: favoritedSubquery},
+	},
+	"comments": {
+		"id":         {column: "comment_models.uuid"},
+		"body":       {column: "comment_models.body"},
+		"created_at": {column: "comment_models.created_at", time: true},
+		"updated_at": {column: "comment_models.updated_at", time: true},
+		"article":    {column: "article_models.slug", subquery: articleSubquery},
+		"article_id": {column: "article_models.uuid", subquery: articleSubquery},
+		"author":     {column: "user_models.username", subquery: fmt.Sprintf(authorSubquery, "comment_models.author_id", "%s")},
+		"author_id":  {column: "user_models.uuid", subquery: fmt.Sprintf(authorSubquery, "comment_models.author_id", "%s")},
+	},
+}
+
+// ParseFilter parses the filter of an export of resource: the expression, ANDed with an equality
+// condition for each of fields (the older form of filters, by field name). Either may be empty.
+func ParseFilter(resource, expr string, fields map[string]string) (*ExportFilter, error) {
+	if _, ok := filterFields[resource]; !ok {
+		return nil, fmt.Errorf("unknown resource: %s", resource)
+	}
+	var clauses []string
+	var args []interface{}
+
+	if strings.TrimSpace(expr) != "" {
+		tokens, err := tokenizeFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		p := &filterParser{resource: resource, tokens: tokens}
+		sql, exprArgs, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.peek(); tok.kind != tokenEnd {
+			return nil, fmt.Errorf("filter: unexpected %s at position %d", tok, tok.pos)
+		}
+		clauses, args = append(clauses, sql), append(args, exprArgs...)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fields[name] == "" {
+			continue
+		}
+		field, err := lookupFilterField(resource, name)
+		if err != nil {
+			return nil, err
+		}
+		sql, condArgs, err := field.condition(name, "=", []string{fields[name]})
+		if err != nil {
+			return nil, err
+		}
+		clauses, args = append(clauses, sql), append(args, condArgs...)
+	}
+
+	return &ExportFilter{sql: strings.Join(clauses, " AND "), args: args}, nil
+}
+
+// apply restricts query to the rows the filter selects
+func (f *ExportFilter) apply(query *gorm.DB) *gorm.DB {
+	if f == nil || f.sql == "" {
+		return query
+	}
+	return query.Where(f.sql, f.args...)
+}
+
+// IsFilterField reports whether the resource can be filtered on the field called name
+func IsFilterField(resource, name string) bool {
+	_, ok := filterFields[resource][name]
+	return ok
+}
+
+func lookupFilterField(resource, name string) (filterField, error) {
+	field, ok := filterFields[resource][name]
+	if !ok {
+		var names []string
+		for n := range filterFields[resource] {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return field, fmt.Errorf("filter: unknown field %q for %s, use: %s", name, resource, strings.Join(names, ", "))
+	}
+	return field, nil
+}
+
+// condition builds the SQL of name op values
+func (f filterField) condition(name, op string, values []string) (string, []interface{}, error) {
+	if f.time {
+		return f.timeCondition(name, op, values[0])
+	}
+	switch op {
+	case "<", "<=", ">", ">=":
+		return "", nil, fmt.Errorf("filter: %s can't be compared with %s", name, op)
+	}
+
+	// Fields of related rows match when any of the related rows does
+	negate := false
+	if f.subquery != "" && op == "!=" {
+		op, negate = "=", true
+	}
+
+	var sql string
+	var args []interface{}
+	switch op {
+	case "=":
+		sql, args = f.column+" = ?", []interface{}{values[0]}
+	case "!=":
+		sql, args = f.column+" <> ?", []interface{}{values[0]}
+	case "IN":
+		sql, args = f.column+" IN ?", []interface{}{values}
+	case "CONTAINS":
+		sql, args = "LOWER("+f.column+") LIKE ? ESCAPE '\\'", []interface{}{"%" + escapeLike(strings.ToLower(values[0])) + "%"}
+	}
+	if f.subquery != "" {
+		sql = fmt.Sprintf(f.subquery, sql)
+	}
+	if negate {
+		sql = "NOT (" + sql + ")"
+	}
+	return sql, args, nil
+}
+
+// timeCondition compares a timestamp. A date stands for the whole UTC day: created_at = 2026-01-31
+// matches the rows created that day, created_at > 2026-01-31 the ones created after it.
+func (f filterField) timeCondition(name, op, value string) (string, []interface{}, error) {
+	if op == "IN" || op == "CONTAINS" {
+		return "", nil, fmt.Errorf("filter: %s can't be compared with %s", name, op)
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		sqlOp := op
+		if op == "!=" {
+			sqlOp = "<>"
+		}
+		return f.column + " " + sqlOp + " ?", []interface{}{t}, nil
+	}
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return "", nil, fmt.Errorf("filter: %s must be an RFC3339 timestamp or a date (YYYY-MM-DD), got %q", name, value)
+	}
+	next := day.AddDate(0, 0, 1)
+	switch op {
+	case "=":
+		return "(" + f.column + " >= ? AND " + f.column + " < ?)", []interface{}{day, next}, nil
+	case "!=":
+		return "(" + f.column + " < ? OR " + f.column + " >= ?)", []interface{}{day, next}, nil
+	case "<", ">=":
+		return f.column + " " + op + " ?", []interface{}{day}, nil
+	case "<=":
+		return f.column + " < ?", []interface{}{next}, nil
+	default: // >
+		return f.column + " >= ?", []interface{}{next}, nil
+	}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenSymbol // ( ) , = != < <= > >=
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int // 1-based position in the expression
+}
+
+func (t filterToken) String() string {
+	if t.kind == tokenEnd {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// keyword reports whether the token is the keyword kw, in any case
+func (t filterToken) keyword(kw string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, kw)
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',' || r == '=':
+			tokens = append(tokens, filterToken{kind: tokenSymbol, text: string(r), pos: i + 1})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, filterToken{kind: tokenSymbol, text: string(runes[i : i+2]), pos: i + 1})
+				i += 2
+			} else if r == '!' {
+				return nil, fmt.Errorf("filter: unexpected '!' at position %d, use != or NOT", i+1)
+			} else {
+				tokens = append(tokens, filterToken{kind: tokenSymbol, text: string(r), pos: i + 1})
+				i++
+			}
+		case r == '"':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("filter: unterminated string starting at position %d", start+1)
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				} else if runes[i] == '"' {
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: b.String(), pos: start + 1})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`(),=!<>"`, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: string(runes[start:i]), pos: start + 1})
+		}
+	}
+	return append(tokens, filterToken{kind: tokenEnd, pos: len(runes) + 1}), nil
+}
+
+// filterParser turns the tokens of a filter expression into SQL, by recursive descent
+type filterParser struct {
+	resource string
+	tokens   []filterToken
+	next     int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	tok := p.tokens[p.next]
+	if tok.kind != tokenEnd {
+		p.next++
+	}
+	return tok
+}
+
+func (p *filterParser) expect(symbol string) error {
+	if tok := p.take(); tok.kind != tokenSymbol || tok.text != symbol {
+		return fmt.Errorf("filter: expected %q at position %d, got %s", symbol, tok.pos, tok)
+	}
+	return nil
+}
+
+// parseOr parses: and { OR and }
+func (p *filterParser) parseOr() (string, []interface{}, error) {
+	sql, args, err := p.parseAnd()
+	if err != nil {
+		return "", nil, err
+	}
+	for p.peek().keyword("OR") {
+		p.take()
+		right, rightArgs, err := p.parseAnd()
+		if err != nil {
+			return "", nil, err
+		}
+		sql, args = "("+sql+" OR "+right+")", append(args, rightArgs...)
+	}
+	return sql, args, nil
+}
+
+// parseAnd parses: unary { AND unary }
+func (p *filterParser) parseAnd() (string, []interface{}, error) {
+	sql, args, err := p.parseUnary()
+	if err != nil {
+		return "", nil, err
+	}
+	for p.peek().keyword("AND") {
+		p.take()
+		right, rightArgs, err := p.parseUnary()
+		if err != nil {
+			return "", nil, err
+		}
+		sql, args = "("+sql+" AND "+right+")", append(args, rightArgs...)
+	}
+	return sql, args, nil
+}
+
+// parseUnary parses: NOT unary | ( or ) | condition
+func (p *filterParser) parseUnary() (string, []interface{}, error) {
+	tok := p.peek()
+	if tok.keyword("NOT") {
+		p.take()
+		sql, args, err := p.parseUnary()
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + sql + ")", args, nil
+	}
+	if tok.kind == tokenSymbol && tok.text == "(" {
+		p.take()
+		sql, args, err := p.parseOr()
+		if err != nil {
+			return "", nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return "", nil, err
+		}
+		return sql, args, nil
+	}
+	return p.parseCondition()
+}
+
+// parseCondition parses: field op value | field IN ( value { , value } )
+func (p *filterParser) parseCondition() (string, []interface{}, error) {
+	tok := p.take()
+	if tok.kind != tokenWord || slices.ContainsFunc([]string{"AND", "OR", "NOT", "IN", "CONTAINS"}, tok.keyword) {
+		return "", nil, fmt.Errorf("filter: expected a field at position %d, got %s", tok.pos, tok)
+	}
+	name := tok.text
+	field, err := lookupFilterField(p.resource, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	opTok := p.take()
+	var op string
+	switch {
+	case opTok.kind == tokenSymbol && slices.Contains([]string{"=", "!=", "<", "<=", ">", ">="}, opTok.text):
+		op = opTok.text
+	case opTok.keyword("IN"), opTok.keyword("CONTAINS"):
+		op = strings.ToUpper(opTok.text)
+	default:
+		return "", nil, fmt.Errorf("filter: expected an operator after %s at position %d, got %s", name, opTok.pos, opTok)
+	}
+
+	var values []string
+	if op == "IN" {
+		if err := p.expect("("); err != nil {
+			return "", nil, err
+		}
+		for {
+			value, err := p.parseValue(op)
+			if err != nil {
+				return "", nil, err
+			}
+			values = append(values, value)
+			if next := p.peek(); next.kind == tokenSymbol && next.text == "," {
+				p.take()
+				continue
+			}
+			break
+		}
+		if err := p.expect(")"); err != nil {
+			return "", nil, err
+		}
+	} else {
+		value, err := p.parseValue(op)
+		if err != nil {
+			return "", nil, err
+		}
+		values = []string{value}
+	}
+	return field.condition(name, op, values)
+}
+
+func (p *filterParser) parseValue(op string) (string, error) {
+	tok := p.take()
+	if tok.kind != tokenWord && tok.kind != tokenString {
+		return "", fmt.Errorf("filter: expected a value after %s at position %d, got %s", op, tok.pos, tok)
+	}
+	return tok.text, nil
+}
@@ -3,8 +3,8 @@ package core
 import (
 	"bufio"
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,6 +15,8 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
@@ -27,32 +29,52 @@ const (
 	MaxErrorLogCount = 1000
 	LogInterval      = 5000
 	MaxRetries       = 3
+
+	// Articles are committed one by one, so progress is reported every ArticleProgressInterval of them
+	ArticleProgressInterval = 100
+
+	// TagSeparator separates the tags of an article held in a single CSV field. A separator or a
+	// backslash within a tag is escaped with a backslash, see joinTags.
+	TagSeparator = "|"
 )
 
 type RawArticleJSON struct {
-	ID          string   `json:"id"`
-	Slug        string   `json:"slug"`
-	Title       string   `json:"title"`
-	Description string   `json:"description"`
-	Body        string   `json:"body"`
-	TagList     []string `json:"tagList"`
-	Tags        []string `json:"tags"`
-	AuthorName  string   `json:"author"`
-	AuthorID    string   `json:"author_id"`
+	ID            string    `json:"id"`
+	Slug          string    `json:"slug"`
+	Title         string    `json:"title"`
+	Description   string    `json:"description"`
+	Body          string    `json:"body"`
+	TagList       []string  `json:"tagList"`
+	Tags          []string  `json:"tags"`
+	AuthorID      string    `json:"author_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	SchemaVersion int       `json:"schema_version"`
 }
 
 type RawCommentJSON struct {
-	ID        string    `json:"id"`
-	ArticleID string    `json:"article_id"`
-	UserID    string    `json:"user_id"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            string    `json:"id"`
+	ArticleID     string    `json:"article_id"`
+	AuthorID      string    `json:"author_id"`
+	UserID        string    `json:"user_id"` // Older name of author_id
+	Body          string    `json:"body"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"`
 }
 
 type RawUserJSON struct {
-	ID, UUID, Email, Username, Name string
+	ID            string `json:"id"`
+	UUID          string `json:"uuid"`
+	Email         string `json:"email"`
+	Username      string `json:"username"`
+	Name          string `json:"name"`
+	Bio           string `json:"bio"`
+	Image         string `json:"image"`
+	SchemaVersion int    `json:"schema_version"`
 }
 
+var errNotAnArray = errors.New("expected JSON array starting with '['")
+
 type JSONArrayReader struct {
 	decoder *json.Decoder
 	started bool
@@ -74,7 +96,7 @@ func (r *JSONArrayReader) Read(v interface{}) error {
 		}
 		delim, ok := tok.(json.Delim)
 		if !ok || delim != '[' {
-			return fmt.Errorf("expected JSON array starting with '['")
+			return errNotAnArray
 		}
 		r.started = true
 	}
@@ -88,14 +110,18 @@ func (r *JSONArrayReader) Read(v interface{}) error {
 	return r.decoder.Decode(v)
 }
 
-func ProcessImport(job *jobs.Job) error {
-	log.Printf(">>> WORKER STARTED processing Job ID: %s", job.ID)
+// Offset is the position in the stream right after the last element read
+func (r *JSONArrayReader) Offset() int64 {
+	return r.decoder.InputOffset()
+}
 
-	reader, err := getStreamFromSource(job.SourceKey)
-	if err != nil {
-		return fmt.Errorf("failed to open stream: %v", err)
-	}
-	defer reader.Close()
+// ProcessImport streams the job's source file into the database.
+// Cancelling ctx stops the import at the next batch boundary; rows already committed stay counted
+// and the error report collected so far is still uploaded.
+// A job carrying a checkpoint from a previous attempt resumes right after it, reading only the rest
+// of the file, and its error report starts with the rows the previous attempts rejected.
+func ProcessImport(ctx context.Context, job *jobs.Job) error {
+	log.Printf(">>> WORKER STARTED processing Job ID: %s", job.ID)
 
 	errFile, err := os.CreateTemp("", fmt.Sprintf("job_errors_%s_*.ndjson", job.ID))
 	if err != nil {
@@ -104,83 +130,217 @@ func ProcessImport(job *jobs.Job) error {
 	defer os.Remove(errFile.Name())
 	defer errFile.Close()
 
+	cp := job.Checkpoint
+	resuming := cp != nil && cp.Offset > 0
+	if resuming {
+		restoreCounters(job, cp)
+		if cp.FailedRows > 0 {
+			seedErrorReport(errorReportKey(job), min(cp.FailedRows, MaxErrorLogCount), errFile)
+		}
+	} else {
+		job.Checkpoint = nil
+	}
+
+	processErr := importSourceFile(ctx, job, cp, resuming, errFile)
+
+	// Every path uploads the report, a resumed import with nothing left to read included
+	if job.FailedRows > 0 {
+		uploadErrorReport(job, errFile.Name())
+	}
+	log.Printf(">>> Job Finished. Processed: %d, Failed: %d", job.ProcessedRows, job.FailedRows)
+	return processErr
+}
+
+// importSourceFile opens the job's source file, from the checkpoint on when resuming, and imports it,
+// writing the rejected rows to errFile
+func importSourceFile(ctx context.Context, job *jobs.Job, cp *jobs.ImportCheckpoint, resuming bool, errFile *os.File) error {
+	var offset int64
+	if resuming {
+		if job.TotalBytes > 0 && cp.Offset >= job.TotalBytes {
+			return nil
+		}
+		log.Printf(">>> Resuming Job %s from record %d (byte %d)", job.ID, cp.Record, cp.Offset)
+		offset = cp.Offset
+	}
+
+	reader, size, err := getStreamFromSource(job.SourceKey, offset)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer reader.Close()
+
+	// The object size lets progress be estimated before the whole file is read
+	job.TotalRows = 0
+	job.BytesRead = offset
+	if size > 0 {
+		job.TotalBytes = offset + size
+	}
+	if err := jobs.SaveProgress(common.GetDB(), job); err != nil {
+		log.Printf("⚠️ Could not save progress of Job %s: %v", job.ID, err)
+	}
+
+	counted := &countingReader{r: reader, job: job}
+	source := newImportSource(counted)
+	if resuming {
+		source, err = resumeSource(counted, cp)
+		if errors.Is(err, errNothingLeft) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resume stream: %w", err)
+		}
+	}
+	source.errReport = errFile.Name()
+	source.reportedRows = job.FailedRows
+
 	errorEncoder := json.NewEncoder(errFile)
-	var processErr error
 
 	// Basic check for NDJSON extension to decide default strategy,
 	// though format detection will handle JSON arrays automatically.
 	isNDJSON := strings.HasSuffix(strings.ToLower(job.SourceKey), ".ndjson") ||
 		strings.HasSuffix(strings.ToLower(job.SourceKey), ".json")
+	// Articles and comments used to be JSON only, they are read as CSV when the file says so
+	isCSV := strings.HasSuffix(strings.ToLower(job.SourceKey), ".csv")
 
 	switch job.Resource {
 	case "users":
 		if isNDJSON {
-			processErr = importUsersNDJSON(reader, job, errorEncoder)
-		} else {
-			processErr = importUsersCSV(reader, job, errorEncoder)
+			return importUsersNDJSON(ctx, source, job, errorEncoder)
 		}
+		return importUsersCSV(ctx, source, job, errorEncoder)
 	case "articles":
-		processErr = importArticlesJSON(reader, job, errorEncoder)
+		if isCSV {
+			return importArticlesCSV(ctx, source, job, errorEncoder)
+		}
+		return importArticlesJSON(ctx, source, job, errorEncoder)
 	case "comments":
-		processErr = importCommentsJSON(reader, job, errorEncoder)
+		if isCSV {
+			return importCommentsCSV(ctx, source, job, errorEncoder)
+		}
+		return importCommentsJSON(ctx, source, job, errorEncoder)
 	default:
-		return fmt.Errorf("unknown resource: %s", job.Resource)
-	}
-
-	if job.FailedRows > 0 {
-		uploadErrorReport(job, errFile.Name())
+		return jobs.Permanent(fmt.Errorf("unknown resource: %s", job.Resource))
 	}
-	log.Printf(">>> Job Finished. Processed: %d, Failed: %d", job.ProcessedRows, job.FailedRows)
-	return processErr
 }
 
-func getStreamFromSource(source string) (io.ReadCloser, error) {
+// getStreamFromSource opens the uploaded file (or remote URL) from offset on, along with the size of
+// what is left to read, 0 when unknown
+func getStreamFromSource(source string, offset int64) (io.ReadCloser, int64, error) {
 	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-		resp, err := http.Get(source)
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return nil, 0, jobs.Permanent(err)
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		if resp.StatusCode != 200 {
+		if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// The checkpoint is at the end of the file
 			resp.Body.Close()
-			return nil, fmt.Errorf("remote URL status: %d", resp.StatusCode)
+			return http.NoBody, 0, nil
 		}
-		return resp.Body, nil
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			err := fmt.Errorf("remote URL status: %d", resp.StatusCode)
+			// Client errors won't go away by asking again
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return nil, 0, jobs.Permanent(err)
+			}
+			return nil, 0, err
+		}
+		size := max(resp.ContentLength, 0)
+		// Servers ignoring the range send the whole file, skip what was already imported
+		if offset > 0 && resp.StatusCode == http.StatusOK {
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, 0, err
+			}
+			size = max(size-offset, 0)
+		}
+		return resp.Body, size, nil
 	}
-	output, err := common.GetS3().GetObject(context.TODO(), &s3.GetObjectInput{
+
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(os.Getenv("S3_BUCKET")),
 		Key:    aws.String(source),
-	})
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	output, err := common.GetS3().GetObject(context.TODO(), input)
 	if err != nil {
-		return nil, err
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, 0, jobs.Permanent(err)
+		}
+		var apiErr smithy.APIError
+		if offset > 0 && errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			// The checkpoint is at the end of the file
+			return http.NoBody, 0, nil
+		}
+		return nil, 0, err
 	}
-	return output.Body, nil
+	return output.Body, aws.ToInt64(output.ContentLength), nil
+}
+
+// countingReader keeps job.BytesRead up to date as the import consumes the source
+type countingReader struct {
+	r   io.Reader
+	job *jobs.Job
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.job.BytesRead += int64(n)
+	return n, err
 }
 
-func uploadErrorReport(job *jobs.Job, filePath string) {
+// errorReportKey is where the error report of an import is uploaded, the same for every attempt
+func errorReportKey(job *jobs.Job) string {
+	return fmt.Sprintf("errors/%s.ndjson", job.ID)
+}
+
+func uploadErrorReport(job *jobs.Job, filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return
+		return err
 	}
 	defer file.Close()
-	key := fmt.Sprintf("errors/%s.ndjson", job.ID)
-	common.GetS3().PutObject(context.TODO(), &s3.PutObjectInput{
+	key := errorReportKey(job)
+	if _, err := common.GetS3().PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(os.Getenv("S3_BUCKET")),
 		Key:    aws.String(key),
 		Body:   file,
-	})
+	}); err != nil {
+		log.Printf("⚠️ Could not upload error report of Job %s: %v", job.ID, err)
+		return err
+	}
 	job.ResultKey = key
+	return nil
 }
 
 // detectFormat peeks at the first byte to decide between NDJSON '{' and Array '['
-func detectFormat(reader io.Reader) (string, io.Reader, error) {
-	bufReader := bufio.NewReader(reader)
+// Leading whitespace is skipped, and counted in the source's offset and line numbers
+func detectFormat(src *importSource) (string, io.Reader, error) {
+	bufReader := bufio.NewReader(src)
 	for {
 		b, err := bufReader.ReadByte()
+		if err == io.EOF {
+			return "", nil, jobs.Permanent(fmt.Errorf("file is empty"))
+		}
 		if err != nil {
 			return "", nil, err
 		}
 		// Skip whitespace
 		if b == ' ' || b == '\n' || b == '\r' || b == '\t' {
+			src.origin++
+			if b == '\n' {
+				src.line++
+			}
 			continue
 		}
 		if err := bufReader.UnreadByte(); err != nil {
@@ -192,11 +352,48 @@ func detectFormat(reader io.Reader) (string, io.Reader, error) {
 		case '{':
 			return "ndjson", bufReader, nil
 		default:
-			return "", nil, fmt.Errorf("unknown format, first byte: %c", b)
+			return "", nil, jobs.Permanent(fmt.Errorf("unknown format, first byte: %c", b))
 		}
 	}
 }
 
+// reportProgress publishes the job's counters to clients following it (GET /v1/jobs/:id/events),
+// and writes them to the job row at most every jobs.ProgressFlushInterval
+func reportProgress(job *jobs.Job) {
+	estimateTotalRows(job)
+	jobs.PublishProgress(job)
+	if !progressDue(job) {
+		return
+	}
+	if err := jobs.SaveProgress(common.GetDB(), job); err != nil {
+		log.Printf("⚠️ Could not save progress of Job %s: %v", job.ID, err)
+	}
+}
+
+// progressDue reports whether the next reportProgress writes the job row
+func progressDue(job *jobs.Job) bool {
+	return time.Since(job.UpdatedAt) >= jobs.ProgressFlushInterval
+}
+
+// estimateTotalRows extrapolates the number of rows in the source from the share of it read so far.
+// The source is read ahead of the rows counted, so the estimate starts a little low and converges.
+func estimateTotalRows(job *jobs.Job) {
+	done := job.ProcessedRows + job.FailedRows + job.SkippedRows
+	if job.TotalBytes <= 0 || job.BytesRead <= 0 || done == 0 {
+		return
+	}
+	estimate := int(float64(done) * float64(job.TotalBytes) / float64(job.BytesRead))
+	job.TotalRows = max(estimate, done)
+}
+
+// cancelled returns the cancellation cause once ctx is done, nil otherwise
+func cancelled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
 func newLargeScanner(reader io.Reader) *bufio.Scanner {
 	scanner := bufio.NewScanner(reader)
 	buf := make([]byte, 0, 64*1024)
@@ -228,215 +425,422 @@ func buildUserModel(raw RawUserJSON) users.UserModel {
 	if user.Username == "" {
 		user.Username = strings.TrimSpace(raw.Name)
 	}
+	setProfile(&user, raw.Bio, raw.Image)
 	return user
 }
 
-func flushUserBatch(db *gorm.DB, users []users.UserModel) error {
-	return db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "email"}},
-		DoUpdates: clause.AssignmentColumns([]string{"uuid"}),
-	}).CreateInBatches(users, 1000).Error
+// setProfile fills the optional profile fields of an imported user
+func setProfile(user *users.UserModel, bio, image string) {
+	user.Bio = strings.TrimSpace(bio)
+	if image = strings.TrimSpace(image); image != "" {
+		user.Image = &image
+	}
 }
 
-func recordError(job *jobs.Job, writer *json.Encoder, errType, id, msg string) {
-	job.FailedRows++
-	if job.FailedRows <= MaxErrorLogCount {
-		writer.Encode(map[string]string{
-			"type":      errType,
-			"id":        id,
-			"message":   msg,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+// userRow is a user waiting in a batch, along with the record it comes from
+type userRow struct {
+	user users.UserModel
+	row  rowRef
 }
 
-func importUsersCSV(reader io.Reader, job *jobs.Job, errWriter *json.Encoder) error {
-	db := common.GetDB()
-	csvReader := csv.NewReader(reader)
-	csvReader.LazyQuotes = true
-	header, err := csvReader.Read()
-	if err != nil {
-		return fmt.Errorf("failed header read: %v", err)
-	}
+// userBatch collects the users of a batch. A file can only hold an email once per batch, the
+// upsert can't touch the same row twice.
+type userBatch struct {
+	job       *jobs.Job
+	errWriter *json.Encoder
+	rows      []userRow
+	emails    map[string]bool
+}
 
-	colMap := make(map[string]int)
-	for i, h := range header {
-		norm := strings.ToLower(strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(h, "\ufeff", ""), "\"", "")))
-		colMap[norm] = i
+func (b *userBatch) add(user users.UserModel, row rowRef) {
+	if user.UUID == "" {
+		missingField(b.job, b.errWriter, row, "", "id")
+		return
+	}
+	if err := users.ValidateUserModel(user); err != nil {
+		validationError(b.job, b.errWriter, row, user.UUID, err)
+		return
 	}
+	if b.emails[user.Email] {
+		recordError(b.job, b.errWriter, row, RowError{Code: "DUPLICATE", Field: "email", ID: user.UUID, Message: "Email repeated within the batch: " + user.Email})
+		return
+	}
+	if b.emails == nil {
+		b.emails = make(map[string]bool)
+	}
+	b.emails[user.Email] = true
+	b.rows = append(b.rows, userRow{user: user, row: row})
+}
 
-	batchSize := 1000
-	var batch []users.UserModel
-	batchEmails := make(map[string]bool)
+func (b *userBatch) reset() {
+	b.rows, b.emails = nil, nil
+}
 
-	for {
-		record, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+// userWriter commits batches of users keyed on their email, applying the job's conflict strategy to
+// the ones that already exist, and counts what happened to each row.
+// A dry run only classifies the rows, remembering the emails earlier batches would have inserted.
+type userWriter struct {
+	db        *gorm.DB
+	job       *jobs.Job
+	errWriter *json.Encoder
+	pending   map[string]bool
+}
+
+func newUserWriter(db *gorm.DB, job *jobs.Job, errWriter *json.Encoder) *userWriter {
+	return &userWriter{db: db, job: job, errWriter: errWriter, pending: make(map[string]bool)}
+}
+
+func (w *userWriter) write(batch []userRow) error {
+	emails := make([]string, len(batch))
+	for i, r := range batch {
+		emails[i] = r.user.Email
+	}
+	var existing []string
+	if err := w.db.Model(&users.UserModel{}).Where("email IN ?", emails).Pluck("email", &existing).Error; err != nil {
+		return fmt.Errorf("failed to look up users: %w", err)
+	}
+	found := make(map[string]bool, len(existing))
+	for _, email := range existing {
+		found[email] = true
+	}
+
+	strategy := w.job.ConflictStrategy()
+	var rows []users.UserModel
+	for _, r := range batch {
+		if !found[r.user.Email] && !w.pending[r.user.Email] {
+			rows = append(rows, r.user)
 			continue
 		}
-
-		user := users.UserModel{PasswordHash: "$2a$14$P..."}
-		if idx, ok := colMap["email"]; ok {
-			user.Email = strings.TrimSpace(record[idx])
+		switch strategy {
+		case jobs.ConflictSkip:
+			w.job.SkippedRows++
+		case jobs.ConflictFail:
+			recordError(w.job, w.errWriter, r.row, RowError{Code: "CONFLICT", Field: "email", ID: r.user.UUID, Message: "User already exists: " + r.user.Email})
+		default:
+			rows = append(rows, r.user)
 		}
-		if idx, ok := colMap["name"]; ok {
-			user.Username = strings.TrimSpace(record[idx])
-		} else if idx, ok := colMap["username"]; ok {
-			user.Username = strings.TrimSpace(record[idx])
+	}
+
+	// Without the update strategy, users created by someone else since the lookup are left alone:
+	// they count as skipped
+	skipped := 0
+	if !w.job.DryRun() && len(rows) > 0 {
+		written, err := flushUserBatch(w.db, rows, strategy)
+		if err != nil {
+			return fmt.Errorf("failed to save users: %w", err)
 		}
-		if idx, ok := colMap["id"]; ok {
-			user.UUID = strings.TrimSpace(record[idx])
-		} else if idx, ok := colMap["uuid"]; ok {
-			user.UUID = strings.TrimSpace(record[idx])
+		if strategy != jobs.ConflictUpdate {
+			skipped = len(rows) - written
 		}
-
-		if user.Email == "" || user.UUID == "" {
+	}
+	for _, user := range rows {
+		if found[user.Email] || w.pending[user.Email] {
+			w.job.UpdatedRows++
 			continue
 		}
-		if batchEmails[user.Email] {
-			continue
+		w.job.InsertedRows++
+		if w.job.DryRun() {
+			w.pending[user.Email] = true
 		}
-		batchEmails[user.Email] = true
+	}
+	w.job.InsertedRows -= skipped
+	w.job.SkippedRows += skipped
+	w.job.ProcessedRows += len(rows) - skipped
+	return nil
+}
 
-		batch = append(batch, user)
-		if len(batch) >= batchSize {
-			flushUserBatch(db, batch)
-			job.ProcessedRows += len(batch)
-			batch = nil
-			batchEmails = make(map[string]bool)
-			if job.ProcessedRows%LogInterval == 0 {
-				log.Printf("📊 Progress: %d users", job.ProcessedRows)
-			}
+// flushUserBatch upserts users on their email and returns how many rows it wrote. Only the update
+// strategy touches existing rows, the other ones never get here with an existing email unless it
+// was created in the meantime, and then leave it out of the count.
+func flushUserBatch(db *gorm.DB, batch []users.UserModel, strategy string) (int, error) {
+	onConflict := clause.OnConflict{Columns: []clause.Column{{Name: "email"}}, DoNothing: true}
+	if strategy == jobs.ConflictUpdate {
+		onConflict = clause.OnConflict{
+			Columns: []clause.Column{{Name: "email"}},
+			DoUpdates: append(clause.AssignmentColumns([]string{"username", "uuid"}),
+				// The profile is only overwritten by files that have one
+				clause.Assignment{Column: clause.Column{Name: "bio"}, Value: gorm.Expr("COALESCE(NULLIF(excluded.bio, ''), user_models.bio)")},
+				clause.Assignment{Column: clause.Column{Name: "image"}, Value: gorm.Expr("COALESCE(excluded.image, user_models.image)")},
+			),
 		}
 	}
+	result := db.Clauses(onConflict).CreateInBatches(batch, 1000)
+	return int(result.RowsAffected), result.Error
+}
 
-	if len(batch) > 0 {
-		flushUserBatch(db, batch)
-		job.ProcessedRows += len(batch)
+// importUsersCSV reads users from the columns of StreamExport's CSV
+func importUsersCSV(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	records, err := newCSVRecords(src, job, errWriter)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-func importUsersNDJSON(reader io.Reader, job *jobs.Job, errWriter *json.Encoder) error {
-	db := common.GetDB()
+	return processUsers(ctx, src, job, errWriter, &records.pos, func() (*RawUserJSON, rowRef, error) {
+		record, row, err := records.next()
+		if err != nil {
+			return nil, row, err
+		}
+		raw := &RawUserJSON{
+			ID:       records.get(record, "id", "uuid"),
+			Email:    records.get(record, "email"),
+			Username: records.get(record, "name", "username"),
+			Bio:      records.get(record, "bio"),
+			Image:    records.get(record, "image"),
+		}
+		var ok bool
+		if raw.SchemaVersion, ok = records.schemaVersion(record, row, raw.ID); !ok {
+			return nil, row, nil
+		}
+		return raw, row, nil
+	})
+}
 
-	format, reader, err := detectFormat(reader)
+func importUsersNDJSON(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	format, reader, err := detectFormat(src)
 	if err != nil {
-		return fmt.Errorf("format detection failed: %v", err)
+		return fmt.Errorf("format detection failed: %w", err)
 	}
 	log.Printf("✓ Detected format: %s", format)
+	src.format = format
+
+	records := newJSONRecords(src, format, reader, job, errWriter)
+	return processUsers(ctx, src, job, errWriter, &records.pos, func() (*RawUserJSON, rowRef, error) {
+		var raw RawUserJSON
+		row, ok, err := records.decode(&raw)
+		if !ok {
+			return nil, row, err
+		}
+		return &raw, row, nil
+	})
+}
 
+// processUsers writes the users next returns until io.EOF, in batches; next returns a nil user for
+// records it already rejected. pos is where the reader behind next is in the stream.
+func processUsers(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder, pos *position, next func() (*RawUserJSON, rowRef, error)) error {
+	writer := newUserWriter(common.GetDB(), job, errWriter)
 	batchSize := 1000
-	var batch []users.UserModel
-	batchEmails := make(map[string]bool)
+	batch := &userBatch{job: job, errWriter: errWriter}
 
-	// Helper closure to process a single user record
-	processUser := func(raw RawUserJSON) {
-		user := buildUserModel(raw)
-		if user.Email != "" && user.UUID != "" && !batchEmails[user.Email] {
-			batchEmails[user.Email] = true
-			batch = append(batch, user)
+	for {
+		raw, row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if raw == nil || !supportedVersion(job, errWriter, row, raw.ID, raw.SchemaVersion) {
+			continue
 		}
 
-		if len(batch) >= batchSize {
-			flushUserBatch(db, batch)
-			job.ProcessedRows += len(batch)
-			batch = nil
-			batchEmails = make(map[string]bool)
+		batch.add(buildUserModel(*raw), row)
+		if len(batch.rows) >= batchSize {
+			if err := writer.write(batch.rows); err != nil {
+				return err
+			}
+			src.checkpoint(job, *pos)
+			batch.reset()
 			if job.ProcessedRows%LogInterval == 0 {
 				log.Printf("📊 Progress: %d users", job.ProcessedRows)
 			}
+			if err := cancelled(ctx); err != nil {
+				return err
+			}
 		}
 	}
 
-	if format == "ndjson" {
-		scanner := newLargeScanner(reader)
-		for scanner.Scan() {
-			var raw RawUserJSON
-			if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
-				continue
-			}
-			processUser(raw)
-		}
-		if err := scanner.Err(); err != nil {
+	if len(batch.rows) > 0 {
+		if err := writer.write(batch.rows); err != nil {
 			return err
 		}
-	} else {
-		arrayReader := newJSONArrayReader(reader)
-		for {
-			var raw RawUserJSON
-			err := arrayReader.Read(&raw)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Printf("⚠️ JSON parse error: %v", err)
-				continue
-			}
-			processUser(raw)
-		}
-	}
-
-	if len(batch) > 0 {
-		flushUserBatch(db, batch)
-		job.ProcessedRows += len(batch)
 	}
-
+	src.checkpoint(job, *pos)
 	return nil
 }
 
-func importArticlesJSON(reader io.Reader, job *jobs.Job, errWriter *json.Encoder) error {
-	db := common.GetDB()
-
-	format, reader, err := detectFormat(reader)
+func importArticlesJSON(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	format, reader, err := detectFormat(src)
 	if err != nil {
-		return fmt.Errorf("format detection failed: %v", err)
+		return fmt.Errorf("format detection failed: %w", err)
 	}
 	log.Printf("✓ Detected format: %s", format)
+	src.format = format
 
-	authorCache := make(map[string]uint)
+	records := newJSONRecords(src, format, reader, job, errWriter)
+	return processArticles(ctx, src, newArticleWriter(common.GetDB(), job, errWriter), &records.pos, func() (*RawArticleJSON, rowRef, error) {
+		var raw RawArticleJSON
+		row, ok, err := records.decode(&raw)
+		if !ok {
+			return nil, row, err
+		}
+		return &raw, row, nil
+	})
+}
 
-	if format == "ndjson" {
-		scanner := newLargeScanner(reader)
-		return processArticlesNDJSON(scanner, db, job, errWriter, authorCache)
+// importArticlesCSV reads articles from the columns of StreamExport's CSV, with the tags of an
+// article in a single tagList column, separated by TagSeparator
+func importArticlesCSV(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	records, err := newCSVRecords(src, job, errWriter)
+	if err != nil {
+		return err
 	}
 
-	arrayReader := newJSONArrayReader(reader)
-	return processArticlesJSONArray(arrayReader, db, job, errWriter, authorCache)
+	return processArticles(ctx, src, newArticleWriter(common.GetDB(), job, errWriter), &records.pos, func() (*RawArticleJSON, rowRef, error) {
+		record, row, err := records.next()
+		if err != nil {
+			return nil, row, err
+		}
+		raw := &RawArticleJSON{
+			ID:          strings.TrimSpace(records.get(record, "id", "uuid")),
+			Slug:        strings.TrimSpace(records.get(record, "slug")),
+			Title:       records.get(record, "title"),
+			Description: records.get(record, "description"),
+			Body:        records.get(record, "body"),
+			TagList:     splitTags(records.get(record, "taglist", "tags", "tag_list")),
+			AuthorID:    strings.TrimSpace(records.get(record, "author_id", "user_id")),
+		}
+		var ok bool
+		if raw.CreatedAt, ok = records.time(record, row, raw.ID, "created_at"); !ok {
+			return nil, row, nil
+		}
+		if raw.UpdatedAt, ok = records.time(record, row, raw.ID, "updated_at"); !ok {
+			return nil, row, nil
+		}
+		if raw.SchemaVersion, ok = records.schemaVersion(record, row, raw.ID); !ok {
+			return nil, row, nil
+		}
+		return raw, row, nil
+	})
+}
+
+// joinTags encodes a tag list into a single CSV field, the way splitTags decodes it: tags separated
+// by TagSeparator, with \| and \\ standing for a | or a \ within a tag
+func joinTags(tags []string) string {
+	escaped := make([]string, len(tags))
+	for i, tag := range tags {
+		escaped[i] = tagEscaper.Replace(tag)
+	}
+	return strings.Join(escaped, TagSeparator)
 }
 
-func processArticlesNDJSON(scanner *bufio.Scanner, db *gorm.DB, job *jobs.Job, errWriter *json.Encoder, authorCache map[string]uint) error {
-	for scanner.Scan() {
-		var raw RawArticleJSON
-		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
-			continue
+var tagEscaper = strings.NewReplacer(`\`, `\\`, TagSeparator, `\`+TagSeparator)
+
+// splitTags decodes a tag list held in a single CSV field, see joinTags
+func splitTags(field string) []string {
+	var tags []string
+	var tag strings.Builder
+	add := func() {
+		if t := strings.TrimSpace(tag.String()); t != "" {
+			tags = append(tags, t)
 		}
-		processOneArticle(db, &raw, job, errWriter, authorCache)
+		tag.Reset()
 	}
-	return scanner.Err()
+	for i := 0; i < len(field); i++ {
+		switch {
+		case field[i] == '\\' && i+1 < len(field):
+			i++
+			tag.WriteByte(field[i])
+		case strings.HasPrefix(field[i:], TagSeparator):
+			add()
+			i += len(TagSeparator) - 1
+		default:
+			tag.WriteByte(field[i])
+		}
+	}
+	add()
+	return tags
 }
 
-func processArticlesJSONArray(arrayReader *JSONArrayReader, db *gorm.DB, job *jobs.Job, errWriter *json.Encoder, authorCache map[string]uint) error {
+// processArticles writes the articles next returns until io.EOF; next returns a nil article for
+// records it already rejected. pos is where the reader behind next is in the stream.
+// Articles are committed one per transaction, so cancellation is checked before each one
+// and a checkpoint is recorded every ArticleProgressInterval of them.
+func processArticles(ctx context.Context, src *importSource, writer *articleWriter, pos *position, next func() (*RawArticleJSON, rowRef, error)) error {
 	for {
-		var raw RawArticleJSON
-		err := arrayReader.Read(&raw)
+		if err := cancelled(ctx); err != nil {
+			return err
+		}
+		raw, row, err := next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Printf("⚠️ JSON parse error: %v", err)
-			continue
+			return err
+		}
+		if raw != nil && supportedVersion(writer.job, writer.errWriter, row, raw.ID, raw.SchemaVersion) {
+			writer.write(raw, row)
+		}
+		if pos.record%ArticleProgressInterval == 0 {
+			src.checkpoint(writer.job, *pos)
 		}
-		processOneArticle(db, &raw, job, errWriter, authorCache)
 	}
+	src.checkpoint(writer.job, *pos)
 	return nil
 }
 
-func processOneArticle(db *gorm.DB, raw *RawArticleJSON, job *jobs.Job, errWriter *json.Encoder, authorCache map[string]uint) bool {
-	if raw.Title == "" {
+// authorResolver maps user UUIDs to article authors, creating the author profile on first use.
+// A dry run only checks that the user exists.
+type authorResolver struct {
+	db     *gorm.DB
+	dryRun bool
+	cache  map[string]uint
+}
+
+func newAuthorResolver(db *gorm.DB, dryRun bool) *authorResolver {
+	return &authorResolver{db: db, dryRun: dryRun, cache: make(map[string]uint)}
+}
+
+// resolve returns the author ID of a user, ok is false when the user doesn't exist.
+// In a dry run the ID is 0 for users who never wrote anything yet.
+func (r *authorResolver) resolve(userUUID string) (id uint, ok bool) {
+	if id, ok := r.cache[userUUID]; ok {
+		return id, true
+	}
+	var u users.UserModel
+	if err := r.db.Select("id").Where("uuid = ?", userUUID).First(&u).Error; err != nil {
+		return 0, false
+	}
+
+	var au articles.ArticleUserModel
+	if r.dryRun {
+		r.db.Where("user_model_id = ?", u.ID).Limit(1).Find(&au)
+	} else if err := r.db.Where("user_model_id = ?", u.ID).FirstOrCreate(&au, articles.ArticleUserModel{
+		UserModelID: u.ID,
+	}).Error; err != nil {
+		return 0, false
+	}
+	r.cache[userUUID] = au.ID
+	return au.ID, true
+}
+
+// articleWriter upserts articles one by one on their slug, counting inserts and updates.
+// A dry run only classifies them, remembering the slugs earlier records would have inserted.
+type articleWriter struct {
+	db        *gorm.DB
+	job       *jobs.Job
+	errWriter *json.Encoder
+	authors   *authorResolver
+	pending   map[string]bool
+}
+
+func newArticleWriter(db *gorm.DB, job *jobs.Job, errWriter *json.Encoder) *articleWriter {
+	return &articleWriter{
+		db:        db,
+		job:       job,
+		errWriter: errWriter,
+		authors:   newAuthorResolver(db, job.DryRun()),
+		pending:   make(map[string]bool),
+	}
+}
+
+func (w *articleWriter) write(raw *RawArticleJSON, row rowRef) bool {
+	db, job, errWriter := w.db, w.job, w.errWriter
+	if err := articles.ValidateArticleModel(articles.ArticleModel{Title: raw.Title, Description: raw.Description, Body: raw.Body}); err != nil {
+		validationError(job, errWriter, row, raw.ID, err)
+		return false
+	}
+	if raw.AuthorID == "" {
+		missingField(job, errWriter, row, raw.ID, "author_id")
 		return false
 	}
 
@@ -445,26 +849,9 @@ func processOneArticle(db *gorm.DB, raw *RawArticleJSON, job *jobs.Job, errWrite
 		tagList = raw.Tags
 	}
 
-	var articleUserID uint
-	if raw.AuthorID != "" {
-		if id, ok := authorCache[raw.AuthorID]; ok {
-			articleUserID = id
-		} else {
-			var u users.UserModel
-			if err := db.Select("id").Where("uuid = ?", raw.AuthorID).First(&u).Error; err == nil {
-				var au articles.ArticleUserModel
-				if err := db.Where("user_model_id = ?", u.ID).FirstOrCreate(&au, articles.ArticleUserModel{
-					UserModelID: u.ID,
-				}).Error; err == nil {
-					articleUserID = au.ID
-					authorCache[raw.AuthorID] = au.ID
-				}
-			}
-		}
-	}
-
-	if articleUserID == 0 {
-		recordError(job, errWriter, "DEPENDENCY_ERROR", raw.Slug, "Author not found: "+raw.AuthorID)
+	articleUserID, found := w.authors.resolve(raw.AuthorID)
+	if !found {
+		recordError(job, errWriter, row, RowError{Code: "DEPENDENCY_ERROR", Field: "author_id", ID: raw.ID, Message: "Author not found: " + raw.AuthorID})
 		return false
 	}
 
@@ -472,6 +859,34 @@ func processOneArticle(db *gorm.DB, raw *RawArticleJSON, job *jobs.Job, errWrite
 		raw.Slug = strings.ReplaceAll(strings.ToLower(raw.Title), " ", "-")
 	}
 
+	// Soft-deleted articles still hold their slug, the upsert revives them
+	var existing int64
+	if err := db.Unscoped().Model(&articles.ArticleModel{}).Where("slug = ?", raw.Slug).Count(&existing).Error; err != nil {
+		recordError(job, errWriter, row, RowError{Code: "LOOKUP_ERROR", ID: raw.ID, Message: err.Error()})
+		return false
+	}
+	update := existing > 0 || w.pending[raw.Slug]
+	if update {
+		switch job.ConflictStrategy() {
+		case jobs.ConflictSkip:
+			job.SkippedRows++
+			return false
+		case jobs.ConflictFail:
+			recordError(job, errWriter, row, RowError{Code: "CONFLICT", Field: "slug", ID: raw.ID, Message: "Article already exists: " + raw.Slug})
+			return false
+		}
+	}
+
+	if job.DryRun() {
+		if !update {
+			w.pending[raw.Slug] = true
+		}
+		w.count(update)
+		return true
+	}
+
+	// created_at is kept from the file when it has one. updated_at is always now: the row changes
+	// here, and incremental exports pick up changes by updated_at.
 	article := articles.ArticleModel{
 		Slug:        raw.Slug,
 		Title:       raw.Title,
@@ -480,14 +895,21 @@ func processOneArticle(db *gorm.DB, raw *RawArticleJSON, job *jobs.Job, errWrite
 		AuthorID:    articleUserID,
 		UUID:        raw.ID,
 	}
+	article.CreatedAt, article.UpdatedAt = raw.CreatedAt, time.Now()
+
+	// An article without an id keeps the one it already has
+	columns := []string{"title", "description", "body", "author_id", "updated_at", "deleted_at"}
+	if raw.ID != "" {
+		columns = append(columns, "uuid")
+	}
 
 	tx := db.Begin()
 	if err := tx.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "slug"}},
-		DoUpdates: clause.AssignmentColumns([]string{"uuid"}),
+		DoUpdates: clause.AssignmentColumns(columns),
 	}).Create(&article).Error; err != nil {
 		tx.Rollback()
-		recordError(job, errWriter, "INSERT_ERROR", raw.Slug, err.Error())
+		recordError(job, errWriter, row, RowError{Code: "INSERT_ERROR", ID: raw.ID, Message: err.Error()})
 		return false
 	}
 
@@ -497,49 +919,122 @@ func processOneArticle(db *gorm.DB, raw *RawArticleJSON, job *jobs.Job, errWrite
 			var tag articles.TagModel
 			if err := tx.FirstOrCreate(&tag, articles.TagModel{Tag: tagName}).Error; err != nil {
 				tx.Rollback()
-				recordError(job, errWriter, "TAG_CREATE_ERROR", raw.Slug, err.Error())
+				recordError(job, errWriter, row, RowError{Code: "TAG_CREATE_ERROR", Field: "tagList", ID: raw.ID, Message: err.Error()})
 				return false
 			}
 			tags = append(tags, tag)
 		}
 		if err := tx.Model(&article).Association("Tags").Replace(tags); err != nil {
 			tx.Rollback()
-			recordError(job, errWriter, "TAG_LINK_ERROR", raw.Slug, err.Error())
+			recordError(job, errWriter, row, RowError{Code: "TAG_LINK_ERROR", Field: "tagList", ID: raw.ID, Message: err.Error()})
 			return false
 		}
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		recordError(job, errWriter, "COMMIT_ERROR", raw.Slug, err.Error())
+		recordError(job, errWriter, row, RowError{Code: "COMMIT_ERROR", ID: raw.ID, Message: err.Error()})
 		return false
 	}
 
-	job.ProcessedRows++
-	if job.ProcessedRows%LogInterval == 0 {
-		log.Printf("📊 Progress: %d articles", job.ProcessedRows)
-	}
-
+	w.count(update)
 	return true
 }
 
-func importCommentsJSON(reader io.Reader, job *jobs.Job, errWriter *json.Encoder) error {
-	db := common.GetDB()
+func (w *articleWriter) count(update bool) {
+	if update {
+		w.job.UpdatedRows++
+	} else {
+		w.job.InsertedRows++
+	}
+	w.job.ProcessedRows++
+	if w.job.ProcessedRows%LogInterval == 0 {
+		log.Printf("📊 Progress: %d articles", w.job.ProcessedRows)
+	}
+}
 
-	format, reader, err := detectFormat(reader)
+func importCommentsJSON(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	format, reader, err := detectFormat(src)
 	if err != nil {
-		return fmt.Errorf("format detection failed: %v", err)
+		return fmt.Errorf("format detection failed: %w", err)
 	}
 	log.Printf("✓ Detected format: %s", format)
+	src.format = format
+
+	records := newJSONRecords(src, format, reader, job, errWriter)
+	return processComments(ctx, src, job, errWriter, &records.pos, func() (*RawCommentJSON, rowRef, error) {
+		var raw RawCommentJSON
+		row, ok, err := records.decode(&raw)
+		if !ok {
+			return nil, row, err
+		}
+		return &raw, row, nil
+	})
+}
+
+// importCommentsCSV reads comments from the columns of StreamExport's CSV
+func importCommentsCSV(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder) error {
+	records, err := newCSVRecords(src, job, errWriter)
+	if err != nil {
+		return err
+	}
 
+	return processComments(ctx, src, job, errWriter, &records.pos, func() (*RawCommentJSON, rowRef, error) {
+		record, row, err := records.next()
+		if err != nil {
+			return nil, row, err
+		}
+		raw := &RawCommentJSON{
+			ID:        strings.TrimSpace(records.get(record, "id", "uuid")),
+			ArticleID: strings.TrimSpace(records.get(record, "article_id")),
+			AuthorID:  strings.TrimSpace(records.get(record, "author_id", "user_id")),
+			Body:      records.get(record, "body"),
+		}
+		var ok bool
+		if raw.CreatedAt, ok = records.time(record, row, raw.ID, "created_at"); !ok {
+			return nil, row, nil
+		}
+		if raw.SchemaVersion, ok = records.schemaVersion(record, row, raw.ID); !ok {
+			return nil, row, nil
+		}
+		return raw, row, nil
+	})
+}
+
+// processComments writes the comments next returns until io.EOF, in batches; next returns a nil
+// comment for records it already rejected. pos is where the reader behind next is in the stream.
+func processComments(ctx context.Context, src *importSource, job *jobs.Job, errWriter *json.Encoder, pos *position, next func() (*RawCommentJSON, rowRef, error)) error {
+	db := common.GetDB()
 	articleCache := make(map[string]uint)
-	authorCache := make(map[string]uint)
+	authors := newAuthorResolver(db, job.DryRun())
+	writer := &commentWriter{db: db, job: job, errWriter: errWriter, pending: make(map[string]bool)}
 	const batchSize = 1000
-	batch := make([]articles.CommentModel, 0, batchSize)
+	batch := make([]commentRow, 0, batchSize)
+	batchIDs := make(map[string]bool)
+
+	flush := func() {
+		writer.write(batch)
+		src.checkpoint(job, *pos)
+		batch = batch[:0]
+		batchIDs = make(map[string]bool)
+	}
 
-	// Helper closure to process a single comment record
-	processComment := func(raw RawCommentJSON) {
-		if raw.Body == "" || raw.ArticleID == "" || raw.UserID == "" {
-			return
+	// Helper closure to process a single comment record, returns the cancellation cause after a flush
+	processComment := func(raw RawCommentJSON, row rowRef) error {
+		if !supportedVersion(job, errWriter, row, raw.ID, raw.SchemaVersion) {
+			return nil
+		}
+		if err := articles.ValidateCommentModel(articles.CommentModel{Body: raw.Body}); err != nil {
+			validationError(job, errWriter, row, raw.ID, err)
+			return nil
+		}
+		if raw.AuthorID == "" {
+			raw.AuthorID = raw.UserID
+		}
+		for _, field := range []struct{ name, value string }{{"article_id", raw.ArticleID}, {"author_id", raw.AuthorID}} {
+			if field.value == "" {
+				missingField(job, errWriter, row, raw.ID, field.name)
+				return nil
+			}
 		}
 
 		var articleID uint
@@ -552,84 +1047,158 @@ func importCommentsJSON(reader io.Reader, job *jobs.Job, errWriter *json.Encoder
 				articleCache[raw.ArticleID] = a.ID
 			}
 		}
+		if articleID == 0 {
+			recordError(job, errWriter, row, RowError{Code: "DEPENDENCY_ERROR", Field: "article_id", ID: raw.ID, Message: "Article not found: " + raw.ArticleID})
+			return nil
+		}
 
-		var authorID uint
-		if id, ok := authorCache[raw.UserID]; ok {
-			authorID = id
-		} else {
-			var u users.UserModel
-			if err := db.Select("id").Where("uuid = ?", raw.UserID).First(&u).Error; err == nil {
-				var au articles.ArticleUserModel
-				if err := db.Where("user_model_id = ?", u.ID).FirstOrCreate(&au, articles.ArticleUserModel{
-					UserModelID: u.ID,
-				}).Error; err == nil {
-					authorID = au.ID
-					authorCache[raw.UserID] = au.ID
-				}
-			}
+		authorID, authorFound := authors.resolve(raw.AuthorID)
+		if !authorFound {
+			recordError(job, errWriter, row, RowError{Code: "DEPENDENCY_ERROR", Field: "author_id", ID: raw.ID, Message: "Author not found: " + raw.AuthorID})
+			return nil
 		}
 
-		if articleID == 0 || authorID == 0 {
-			recordError(job, errWriter, "DEPENDENCY_ERROR", raw.ID, "Missing Article or Author")
-			return
+		if raw.ID != "" {
+			if batchIDs[raw.ID] {
+				recordError(job, errWriter, row, RowError{Code: "DUPLICATE", Field: "id", ID: raw.ID, Message: "Comment repeated within the batch: " + raw.ID})
+				return nil
+			}
+			batchIDs[raw.ID] = true
 		}
 
 		comment := articles.CommentModel{
 			Body:      raw.Body,
 			ArticleID: articleID,
 			AuthorID:  authorID,
+			UUID:      raw.ID,
 		}
 		if !raw.CreatedAt.IsZero() {
 			comment.CreatedAt = raw.CreatedAt
 		}
-		batch = append(batch, comment)
+		batch = append(batch, commentRow{comment: comment, row: row})
 
 		if len(batch) >= batchSize {
-			if err := saveBatchWithRetry(db, &batch); err != nil {
-				recordError(job, errWriter, "BATCH_ERROR", raw.ID, fmt.Sprintf("Batch failed: %v", err))
-			}
-			job.ProcessedRows += len(batch)
-			batch = batch[:0]
+			flush()
 			if job.ProcessedRows%LogInterval == 0 {
 				log.Printf("📊 Progress: %d comments", job.ProcessedRows)
 			}
+			return cancelled(ctx)
 		}
+		return nil
 	}
 
-	if format == "ndjson" {
-		scanner := newLargeScanner(reader)
-		for scanner.Scan() {
-			var raw RawCommentJSON
-			if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
-				continue
-			}
-			processComment(raw)
+	for {
+		raw, row, err := next()
+		if err == io.EOF {
+			break
 		}
-		if err := scanner.Err(); err != nil {
+		if err != nil {
 			return err
 		}
-	} else {
-		arrayReader := newJSONArrayReader(reader)
-		for {
-			var raw RawCommentJSON
-			err := arrayReader.Read(&raw)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Printf("⚠️ JSON parse error: %v", err)
-				continue
+		if raw == nil {
+			continue
+		}
+		if err := processComment(*raw, row); err != nil {
+			return err
+		}
+	}
+
+	flush()
+	return nil
+}
+
+// commentRow is a comment waiting in a batch, along with the record it comes from
+type commentRow struct {
+	comment articles.CommentModel
+	row     rowRef
+}
+
+// commentWriter commits batches of comments. Comments carrying an id are keyed on it and the job's
+// conflict strategy applies to the ones already imported; comments without one are always new rows.
+// A dry run only classifies them, remembering the ids earlier batches would have inserted.
+type commentWriter struct {
+	db        *gorm.DB
+	job       *jobs.Job
+	errWriter *json.Encoder
+	pending   map[string]bool
+}
+
+func (w *commentWriter) write(batch []commentRow) {
+	job := w.job
+	var ids []string
+	for _, r := range batch {
+		if r.comment.UUID != "" {
+			ids = append(ids, r.comment.UUID)
+		}
+	}
+	found := make(map[string]bool)
+	if len(ids) > 0 {
+		var existing []string
+		if err := w.db.Unscoped().Model(&articles.CommentModel{}).Where("uuid IN ?", ids).Pluck("uuid", &existing).Error; err != nil {
+			for _, r := range batch {
+				recordError(job, w.errWriter, r.row, RowError{Code: "LOOKUP_ERROR", ID: r.comment.UUID, Message: fmt.Sprintf("Batch failed: %v", err)})
 			}
-			processComment(raw)
+			return
+		}
+		for _, id := range existing {
+			found[id] = true
 		}
 	}
 
-	if len(batch) > 0 {
-		if err := saveBatchWithRetry(db, &batch); err != nil {
-			recordError(job, errWriter, "BATCH_ERROR", "FINAL", err.Error())
+	var inserts, updates []commentRow
+	for _, r := range batch {
+		id := r.comment.UUID
+		if id == "" || (!found[id] && !w.pending[id]) {
+			inserts = append(inserts, r)
+			continue
+		}
+		switch job.ConflictStrategy() {
+		case jobs.ConflictSkip:
+			job.SkippedRows++
+		case jobs.ConflictFail:
+			recordError(job, w.errWriter, r.row, RowError{Code: "CONFLICT", Field: "id", ID: id, Message: "Comment already exists: " + id})
+		default:
+			updates = append(updates, r)
 		}
-		job.ProcessedRows += len(batch)
 	}
 
-	return nil
+	if job.DryRun() {
+		for _, r := range inserts {
+			if r.comment.UUID != "" {
+				w.pending[r.comment.UUID] = true
+			}
+		}
+	} else {
+		if len(inserts) > 0 {
+			comments := make([]articles.CommentModel, len(inserts))
+			for i, r := range inserts {
+				comments[i] = r.comment
+			}
+			if err := saveBatchWithRetry(w.db, &comments); err != nil {
+				for _, r := range inserts {
+					recordError(job, w.errWriter, r.row, RowError{Code: "BATCH_ERROR", ID: r.comment.UUID, Message: fmt.Sprintf("Batch failed: %v", err)})
+				}
+				inserts = nil
+			}
+		}
+		kept := updates[:0]
+		for _, r := range updates {
+			c := r.comment
+			// Soft-deleted comments come back
+			fields := map[string]interface{}{"body": c.Body, "article_id": c.ArticleID, "author_id": c.AuthorID, "deleted_at": nil}
+			if !c.CreatedAt.IsZero() {
+				fields["created_at"] = c.CreatedAt
+			}
+			if err := w.db.Unscoped().Model(&articles.CommentModel{}).Where("uuid = ?", c.UUID).Updates(fields).Error; err != nil {
+				recordError(job, w.errWriter, r.row, RowError{Code: "UPDATE_ERROR", ID: c.UUID, Message: err.Error()})
+				continue
+			}
+			kept = append(kept, r)
+		}
+		updates = kept
+	}
+
+	job.InsertedRows += len(inserts)
+	job.UpdatedRows += len(updates)
+	job.ProcessedRows += len(inserts) + len(updates)
 }
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// expansionFields are the fields each expansion adds to articles, nested for JSON and flattened for CSV.
+// tagList belongs to the article schema, so tags adds no field of its own: it only loads the tags,
+// which every export holding tagList does anyway.
+var expansionFields = map[string]struct{ nested, flat []string }{
+	jobs.ExpandTags:           {},
+	jobs.ExpandAuthor:         {nested: []string{"author"}, flat: []string{"author_username", "author_bio", "author_image"}},
+	jobs.ExpandComments:       {nested: []string{"comments", "comments_count"}, flat: []string{"comments_count"}},
+	jobs.ExpandFavoritesCount: {nested: []string{"favorites_count"}, flat: []string{"favorites_count"}},
+}
+
+// expandFields are the fields the expansions add to articles, in the order of expand
+func expandFields(expand []string, flat bool) []string {
+	var fields []string
+	for _, name := range expand {
+		if flat {
+			fields = append(fields, expansionFields[name].flat...)
+		} else {
+			fields = append(fields, expansionFields[name].nested...)
+		}
+	}
+	return fields
+}
+
+// exportField is a field of the exported records, written under the name as
+type exportField struct {
+	name, as string
+}
+
+// ValidateFields checks the fields option of an export, see parseFields
+func ValidateFields(resource, format string, expand, fields []string) error {
+	_, _, err := parseFields(resource, format, expand, fields)
+	return err
+}
+
+// parseFields resolves the fields option of an export into the fields of its records, in order.
+// Each entry holds field names separated by commas, each one optionally renamed with name:alias.
+// Naming a field of an article expansion brings the expansion along, so the expansions to load come
+// back too. Without fields, records hold every field of the schema and of the expansions.
+func parseFields(resource, format string, expand, specs []string) ([]exportField, []string, error) {
+	flat := format == "csv"
+	var names []string
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		var fields []exportField
+		for _, name := range append(slices.Clone(recordFields[resource]), expandFields(expand, flat)...) {
+			fields = append(fields, exportField{name: name, as: name})
+		}
+		return fields, loadedExpansions(fields, expand), nil
+	}
+
+	requested := make(map[string]bool)
+	for _, name := range expand {
+		requested[name] = true
+	}
+	var fields []exportField
+	seen := make(map[string]bool)
+	for _, spec := range names {
+		name, as, renamed := strings.Cut(spec, ":")
+		name, as = strings.TrimSpace(name), strings.TrimSpace(as)
+		if !renamed {
+			as = name
+		}
+		if as == "" {
+			return nil, nil, fmt.Errorf("field %q has an empty alias", name)
+		}
+
+		if !slices.Contains(recordFields[resource], name) {
+			expansion := ""
+			if resource == "articles" {
+				for _, option := range jobs.ExpandOptions {
+					if slices.Contains(expandFields([]string{option}, flat), name) {
+						expansion = option
+					}
+				}
+			}
+			if expansion == "" {
+				return nil, nil, fmt.Errorf("unknown field %q, use: %s", name, strings.Join(availableFields(resource, flat), ", "))
+			}
+			requested[expansion] = true
+		}
+
+		if seen[as] {
+			return nil, nil, fmt.Errorf("field %q appears more than once", as)
+		}
+		seen[as] = true
+		fields = append(fields, exportField{name: name, as: as})
+	}
+
+	expand = nil
+	for _, option := range jobs.ExpandOptions {
+		if requested[option] {
+			expand = append(expand, option)
+		}
+	}
+	return fields, loadedExpansions(fields, expand), nil
+}
+
+// loadedExpansions are the expansions to load for the fields of an export: expand, with tags loaded
+// exactly when tagList is one of the fields
+func loadedExpansions(fields []exportField, expand []string) []string {
+	loaded := slices.DeleteFunc(slices.Clone(expand), func(name string) bool { return name == jobs.ExpandTags })
+	if slices.ContainsFunc(fields, func(f exportField) bool { return f.name == "tagList" }) {
+		loaded = append([]string{jobs.ExpandTags}, loaded...)
+	}
+	return loaded
+}
+
+// availableFields are the fields an export of the resource can hold
+func availableFields(resource string, flat bool) []string {
+	fields := slices.Clone(recordFields[resource])
+	if resource == "articles" {
+		for _, field := range expandFields(jobs.ExpandOptions, flat) {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// writeJSONRecord writes the fields of data as a JSON object, in order and followed by a newline
+func writeJSONRecord(writer io.Writer, data map[string]interface{}, fields []exportField) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.as)
+		value, err := json.Marshal(data[field.name])
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// position is how far into its stream an importer is: right after the record-th record of the
+// file, which ends on the line-th line of the stream
+type position struct {
+	offset int64
+	record int
+	line   int
+}
+
+// jsonRecords reads the records of an NDJSON or JSON array stream one at a time, along with where
+// each one is in the source file
+type jsonRecords struct {
+	src       *importSource
+	job       *jobs.Job
+	errWriter *json.Encoder
+	scanner   *bufio.Scanner
+	array     *JSONArrayReader
+	pos       position
+}
+
+func newJSONRecords(src *importSource, format string, reader io.Reader, job *jobs.Job, errWriter *json.Encoder) *jsonRecords {
+	r := &jsonRecords{src: src, job: job, errWriter: errWriter, pos: position{record: src.record}}
+	if format == "ndjson" {
+		r.scanner = newOffsetScanner(reader, &r.pos.offset)
+	} else {
+		r.array = newJSONArrayReader(reader)
+	}
+	return r
+}
+
+// next returns the next record, io.EOF at the end of the stream. Blank NDJSON lines are not records.
+// A JSON array the decoder can't read past is recorded as a parse error and ends the stream.
+func (r *jsonRecords) next() ([]byte, rowRef, error) {
+	if r.scanner != nil {
+		for r.scanner.Scan() {
+			r.pos.line++
+			line := r.scanner.Bytes()
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			r.pos.record++
+			return line, newRowRef(r.pos.record, r.src.line+r.pos.line, line), nil
+		}
+		if err := r.scanner.Err(); err != nil {
+			return nil, rowRef{}, err
+		}
+		return nil, rowRef{}, io.EOF
+	}
+
+	var raw json.RawMessage
+	err := r.array.Read(&raw)
+	if err == io.EOF {
+		return nil, rowRef{}, io.EOF
+	}
+	var syntaxErr *json.SyntaxError
+	if err != nil && (errors.As(err, &syntaxErr) || errors.Is(err, errNotAnArray) || err == io.ErrUnexpectedEOF) {
+		row := rowRef{record: r.pos.record + 1}
+		recordError(r.job, r.errWriter, row, RowError{Code: "PARSE_ERROR", Message: err.Error() + ", the rest of the file can't be read"})
+		r.pos.record++
+		return nil, rowRef{}, io.EOF
+	}
+	if err != nil {
+		return nil, rowRef{}, err
+	}
+	r.pos.record++
+	r.pos.offset = r.array.Offset()
+	return raw, newRowRef(r.pos.record, 0, raw), nil
+}
+
+// decode reads the next record into v. ok is false for a record that doesn't decode into v, which
+// is recorded as a parse error.
+func (r *jsonRecords) decode(v interface{}) (row rowRef, ok bool, err error) {
+	data, row, err := r.next()
+	if err != nil {
+		return row, false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		parseError(r.job, r.errWriter, row, err)
+		return row, false, nil
+	}
+	return row, true, nil
+}
+
+// csvRecords reads the records of a CSV stream one at a time, along with where each one is in the
+// source file, and looks their fields up by column name
+type csvRecords struct {
+	src       *importSource
+	job       *jobs.Job
+	errWriter *json.Encoder
+	reader    *csv.Reader
+	columns   map[string]int
+	pos       position
+}
+
+// newCSVRecords reads the header of a CSV stream. Column names are matched case-insensitively,
+// ignoring a byte order mark, quotes and surrounding spaces.
+func newCSVRecords(src *importSource, job *jobs.Job, errWriter *json.Encoder) (*csvRecords, error) {
+	reader := csv.NewReader(src)
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if err == io.EOF || errors.As(err, &parseErr) {
+			return nil, jobs.Permanent(fmt.Errorf("failed header read: %w", err))
+		}
+		return nil, fmt.Errorf("failed header read: %w", err)
+	}
+	src.format, src.header = "csv", header
+
+	columns := make(map[string]int)
+	for i, h := range header {
+		norm := strings.ToLower(strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(h, "\ufeff", ""), "\"", "")))
+		columns[norm] = i
+	}
+	r := &csvRecords{src: src, job: job, errWriter: errWriter, reader: reader, columns: columns, pos: position{record: src.record}}
+	r.pos.line = r.lastLine(header)
+	return r, nil
+}
+
+// next returns the next record, io.EOF at the end of the stream. Records that can't be parsed are
+// recorded as parse errors and skipped.
+func (r *csvRecords) next() ([]string, rowRef, error) {
+	for {
+		record, err := r.reader.Read()
+		if err == io.EOF {
+			return nil, rowRef{}, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return nil, rowRef{}, err
+		}
+		r.pos.record++
+		r.pos.offset = r.reader.InputOffset()
+
+		// A record with the wrong number of fields still comes back, other parse errors lose it
+		var row rowRef
+		if record != nil {
+			line, _ := r.reader.FieldPos(0)
+			r.pos.line = r.lastLine(record)
+			row = csvRowRef(r.pos.record, r.src.line+line, record)
+		} else {
+			r.pos.line = parseErr.Line
+			row = rowRef{record: r.pos.record, line: r.src.line + parseErr.StartLine}
+		}
+		if parseErr != nil {
+			recordError(r.job, r.errWriter, row, RowError{Code: "PARSE_ERROR", Message: parseErr.Err.Error()})
+			continue
+		}
+		return record, row, nil
+	}
+}
+
+// get returns the record's value in the first of the columns the file has, "" when it has none of them
+func (r *csvRecords) get(record []string, columns ...string) string {
+	for _, column := range columns {
+		if i, ok := r.columns[column]; ok {
+			return record[i]
+		}
+	}
+	return ""
+}
+
+// lastLine is the line of the stream the record just read ends on
+func (r *csvRecords) lastLine(record []string) int {
+	last := len(record) - 1
+	line, _ := r.reader.FieldPos(last)
+	return line + strings.Count(record[last], "\n")
+}
+
+// time parses an RFC 3339 column, the zero time when empty. A value that doesn't parse rejects the
+// record as a parse error, and ok is false.
+func (r *csvRecords) time(record []string, row rowRef, id, column string) (t time.Time, ok bool) {
+	field := strings.TrimSpace(r.get(record, column))
+	if field == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, field)
+	if err != nil {
+		recordError(r.job, r.errWriter, row, RowError{Code: "PARSE_ERROR", Field: column, ID: id, Message: err.Error()})
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// schemaVersion parses the schema_version column, 0 when empty. A value that isn't a number rejects
+// the record as a parse error, and ok is false.
+func (r *csvRecords) schemaVersion(record []string, row rowRef, id string) (version int, ok bool) {
+	field := strings.TrimSpace(r.get(record, "schema_version"))
+	if field == "" {
+		return 0, true
+	}
+	version, err := strconv.Atoi(field)
+	if err != nil {
+		recordError(r.job, r.errWriter, row, RowError{Code: "PARSE_ERROR", Field: "schema_version", ID: id, Message: err.Error()})
+		return 0, false
+	}
+	return version, true
+}
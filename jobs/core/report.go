@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// MaxRawRowBytes caps the copy of the original record kept in an error report entry
+const MaxRawRowBytes = 4096
+
+// RowError is one entry of an import's error report
+type RowError struct {
+	Record    int               `json:"record,omitempty"` // 1-based, the CSV header is not a record
+	Line      int               `json:"line,omitempty"`   // Line the record starts on, not set for JSON arrays
+	Code      string            `json:"code"`
+	Field     string            `json:"field,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Message   string            `json:"message"`
+	Errors    map[string]string `json:"errors,omitempty"` // Every rule the record breaks, by field
+	Raw       string            `json:"raw,omitempty"`
+	Timestamp string            `json:"timestamp"`
+}
+
+// rowRef locates a record in the source file
+type rowRef struct {
+	record int
+	line   int
+	raw    string
+}
+
+func newRowRef(record, line int, raw []byte) rowRef {
+	if len(raw) > MaxRawRowBytes {
+		raw = raw[:MaxRawRowBytes]
+	}
+	return rowRef{record: record, line: line, raw: string(raw)}
+}
+
+// csvRowRef re-encodes a parsed CSV record for the report
+func csvRowRef(record, line int, fields []string) rowRef {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return newRowRef(record, line, bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+// recordError counts a rejected record and, up to MaxErrorLogCount of them, writes it to the report
+func recordError(job *jobs.Job, writer *json.Encoder, row rowRef, entry RowError) {
+	job.FailedRows++
+	if job.FailedRows <= MaxErrorLogCount {
+		entry.Record, entry.Line, entry.Raw = row.record, row.line, row.raw
+		entry.Timestamp = time.Now().Format(time.RFC3339)
+		writer.Encode(entry)
+	}
+}
+
+// parseError records a record that doesn't decode into the resource's fields
+func parseError(job *jobs.Job, errWriter *json.Encoder, row rowRef, err error) {
+	entry := RowError{Code: "PARSE_ERROR", Message: err.Error()}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		entry.Field = typeErr.Field
+	}
+	recordError(job, errWriter, row, entry)
+}
+
+// missingField records a record lacking a required field
+func missingField(job *jobs.Job, errWriter *json.Encoder, row rowRef, id, field string) {
+	recordError(job, errWriter, row, RowError{Code: "MISSING_FIELD", Field: field, ID: id, Message: field + " is required"})
+}
+
+// validationError records a record that breaks the API's validation rules. The entry points at the
+// first field at fault and lists them all, worded by common.NewValidatorError like the API's 422
+// responses.
+func validationError(job *jobs.Job, errWriter *json.Encoder, row rowRef, id string, err error) {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		recordError(job, errWriter, row, RowError{Code: "VALIDATION_ERROR", ID: id, Message: err.Error()})
+		return
+	}
+
+	entry := RowError{Code: "VALIDATION_ERROR", ID: id, Field: strings.ToLower(errs[0].Field()), Errors: make(map[string]string)}
+	if errs[0].Tag() == "required" {
+		entry.Code = "MISSING_FIELD"
+	}
+	apiErrors := common.NewValidatorError(errs).Errors
+	var messages []string
+	for _, e := range errs {
+		field := strings.ToLower(e.Field())
+		message := fmt.Sprint(apiErrors[e.Field()])
+		entry.Errors[field] = message
+		messages = append(messages, field+" "+message)
+	}
+	entry.Message = strings.Join(messages, ", ")
+	recordError(job, errWriter, row, entry)
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// SchemaVersion is the version of the records StreamExport writes and ProcessImport reads, so that
+// an export can always be imported back as is.
+// Adding a field keeps the version. Renaming or removing one, or changing what it holds, bumps it.
+// Records without a schema_version are read as the current version.
+const SchemaVersion = 1
+
+// recordFields are the fields of each resource's records, in the order of the CSV columns.
+// Every entity is referred to by its UUID: id, author_id and article_id. An article's tags are in
+// tagList, a list in JSON and a single field in CSV.
+var recordFields = map[string][]string{
+	"users":    {"id", "username", "email", "bio", "image", "schema_version"},
+	"articles": {"id", "slug", "title", "description", "body", "created_at", "updated_at", "author_id", "schema_version", "tagList"},
+	"comments": {"id", "body", "article_id", "author_id", "created_at", "schema_version"},
+}
+
+// supportedVersion rejects records written with a schema this version of the importer doesn't know
+func supportedVersion(job *jobs.Job, errWriter *json.Encoder, row rowRef, id string, version int) bool {
+	if version >= 0 && version <= SchemaVersion {
+		return true
+	}
+	recordError(job, errWriter, row, RowError{
+		Code:    "UNSUPPORTED_VERSION",
+		Field:   "schema_version",
+		ID:      id,
+		Message: fmt.Sprintf("schema_version %d is not supported, expected at most %d", version, SchemaVersion),
+	})
+	return false
+}
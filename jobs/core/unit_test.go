@@ -0,0 +1,1298 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/testutil"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	return testutil.SetupDB(t, append(testutil.AppModels(), &jobs.Job{})...)
+}
+
+func usersCSV(n int) string {
+	var b strings.Builder
+	b.WriteString("id,email,name\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "uuid-%d,user%d@example.com,user%d\n", i, i, i)
+	}
+	return b.String()
+}
+
+func TestImportUsersCSV_StopsAtBatchBoundaryWhenCancelled(t *testing.T) {
+	db := setupTestDB(t)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(jobs.ErrJobCancelled)
+
+	job := &jobs.Job{Resource: "users"}
+	var errs bytes.Buffer
+	err := importUsersCSV(ctx, newImportSource(strings.NewReader(usersCSV(2500))), job, json.NewEncoder(&errs))
+
+	assert.ErrorIs(t, err, jobs.ErrJobCancelled)
+	// The first batch was committed before the check, nothing after it
+	assert.Equal(t, 1000, job.ProcessedRows)
+
+	var count int64
+	db.Model(&users.UserModel{}).Count(&count)
+	assert.EqualValues(t, job.ProcessedRows, count)
+}
+
+func TestStreamExport_StopsWhenCancelled(t *testing.T) {
+	db := setupTestDB(t)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Create(&users.UserModel{
+			Username:     fmt.Sprintf("user%d", i),
+			Email:        fmt.Sprintf("user%d@example.com", i),
+			PasswordHash: "x",
+		}).Error)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(jobs.ErrJobCancelled)
+
+	var out bytes.Buffer
+	rows, err := StreamExport(ctx, "users", ExportOptions{Format: "ndjson"}, &out)
+	assert.ErrorIs(t, err, jobs.ErrJobCancelled)
+	assert.Zero(t, rows)
+
+	rows, err = StreamExport(context.Background(), "users", ExportOptions{Format: "ndjson"}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, rows)
+}
+
+func TestImportUsersCSV_PublishesProgressPerBatch(t *testing.T) {
+	setupTestDB(t)
+
+	job := &jobs.Job{ID: uuid.New(), Resource: "users", Status: jobs.StatusProcessing}
+	updates, unsubscribe := jobs.GetEventBroker().Subscribe(job.ID)
+	defer unsubscribe()
+
+	var errs bytes.Buffer
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(strings.NewReader(usersCSV(2500))), job, json.NewEncoder(&errs)))
+
+	var processed []int
+	for len(updates) > 0 {
+		processed = append(processed, (<-updates).ProcessedRows)
+	}
+	assert.Equal(t, []int{1000, 2000, 2500}, processed)
+}
+
+func TestStreamExport_ReportsProgress(t *testing.T) {
+	db := setupTestDB(t)
+	for i := 0; i < 2500; i++ {
+		require.NoError(t, db.Create(&users.UserModel{
+			Username:     fmt.Sprintf("user%d", i),
+			Email:        fmt.Sprintf("user%d@example.com", i),
+			PasswordHash: "x",
+		}).Error)
+	}
+
+	var reported []int
+	var out bytes.Buffer
+	rows, err := StreamExport(context.Background(), "users", ExportOptions{
+		Format:     "csv",
+		OnProgress: func(rows int) { reported = append(reported, rows) },
+	}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 2500, rows)
+	assert.Equal(t, []int{1000, 2000}, reported)
+}
+
+func TestImportUsersCSV_SavesProgressToJobRow(t *testing.T) {
+	db := setupTestDB(t)
+
+	data := usersCSV(2500)
+	job := &jobs.Job{ID: uuid.New(), Type: jobs.TypeImport, Resource: "users", Status: jobs.StatusProcessing, WorkerID: "import-0"}
+	require.NoError(t, db.Create(job).Error)
+	job.TotalBytes = int64(len(data))
+
+	// Throttled: nothing is written while the last flush is recent
+	orig := jobs.ProgressFlushInterval
+	jobs.ProgressFlushInterval = time.Hour
+	t.Cleanup(func() { jobs.ProgressFlushInterval = orig })
+
+	var errs bytes.Buffer
+	job.UpdatedAt = time.Now()
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(&countingReader{r: strings.NewReader(usersCSV(1500)), job: job}), job, json.NewEncoder(&errs)))
+	var saved jobs.Job
+	require.NoError(t, db.First(&saved, "id = ?", job.ID).Error)
+	assert.Zero(t, saved.ProcessedRows)
+
+	// Unthrottled: every batch is written
+	jobs.ProgressFlushInterval = 0
+	job.ProcessedRows, job.BytesRead = 0, 0
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(&countingReader{r: strings.NewReader(data), job: job}), job, json.NewEncoder(&errs)))
+
+	var reloaded jobs.Job
+	require.NoError(t, db.First(&reloaded, "id = ?", job.ID).Error)
+	assert.Equal(t, 2500, reloaded.ProcessedRows)
+	assert.Equal(t, int64(len(data)), reloaded.BytesRead)
+	assert.Equal(t, int64(len(data)), reloaded.TotalBytes)
+	assert.Equal(t, 2500, reloaded.TotalRows, "the estimate is exact once the whole file is read")
+}
+
+func TestEstimateTotalRows(t *testing.T) {
+	job := &jobs.Job{TotalBytes: 10000, BytesRead: 2500, ProcessedRows: 90, FailedRows: 10}
+	estimateTotalRows(job)
+	assert.Equal(t, 400, job.TotalRows)
+
+	// Unknown size: the total stays unknown
+	job = &jobs.Job{BytesRead: 2500, ProcessedRows: 100}
+	estimateTotalRows(job)
+	assert.Zero(t, job.TotalRows)
+}
+
+func usersNDJSON(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "{\"id\":\"uuid-%d\",\"email\":\"user%d@example.com\",\"username\":\"user%d\"}\n", i, i, i)
+	}
+	return b.String()
+}
+
+func usersJSONArray(n int) string {
+	var b strings.Builder
+	b.WriteString("[\n")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		fmt.Fprintf(&b, "  {\"id\":\"uuid-%d\",\"email\":\"user%d@example.com\",\"username\":\"user%d\"}", i, i, i)
+	}
+	b.WriteString("\n]\n")
+	return b.String()
+}
+
+func TestProcessImport_ResumesFromCheckpoint(t *testing.T) {
+	tests := []struct {
+		name, file, data string
+		lines            int // Line numbers are only kept for line-based formats
+	}{
+		{"csv", "users.csv", usersCSV(2500), 2501},
+		{"ndjson", "users.ndjson", usersNDJSON(2500), 2500},
+		{"json array", "users.json", usersJSONArray(2500), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				http.ServeContent(w, r, tt.file, time.Time{}, strings.NewReader(tt.data))
+			}))
+			defer server.Close()
+
+			job := &jobs.Job{ID: uuid.New(), Type: jobs.TypeImport, Resource: "users", Status: jobs.StatusProcessing,
+				WorkerID: "import-0", SourceKey: server.URL + "/" + tt.file}
+			require.NoError(t, db.Create(job).Error)
+
+			// Every checkpoint is written, as if the worker crashed right after the first batch
+			orig := jobs.ProgressFlushInterval
+			jobs.ProgressFlushInterval = 0
+			t.Cleanup(func() { jobs.ProgressFlushInterval = orig })
+
+			// First attempt stops after its first batch
+			ctx, cancel := context.WithCancelCause(context.Background())
+			cancel(jobs.ErrJobCancelled)
+			assert.ErrorIs(t, ProcessImport(ctx, job), jobs.ErrJobCancelled)
+			require.NotNil(t, job.Checkpoint)
+			assert.Equal(t, 1000, job.Checkpoint.Record)
+			assert.Equal(t, 1, job.Checkpoint.Batch)
+
+			// The checkpoint made it to the row, the retry starts from there
+			var retry jobs.Job
+			require.NoError(t, db.First(&retry, "id = ?", job.ID).Error)
+			require.NotNil(t, retry.Checkpoint)
+			assert.Equal(t, *job.Checkpoint, *retry.Checkpoint)
+			retry.ProcessedRows, retry.FailedRows, retry.BytesRead = 0, 0, 0
+
+			require.NoError(t, ProcessImport(context.Background(), &retry))
+			assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", job.Checkpoint.Offset)}, ranges)
+			assert.Equal(t, 2500, retry.ProcessedRows)
+			assert.Equal(t, 2500, retry.Checkpoint.Record)
+			if tt.lines > 0 {
+				assert.Equal(t, tt.lines, retry.Checkpoint.Line)
+			}
+			assert.Equal(t, int64(len(tt.data)), retry.TotalBytes)
+			assert.Equal(t, int64(len(tt.data)), retry.BytesRead)
+
+			var count int64
+			db.Model(&users.UserModel{}).Count(&count)
+			assert.EqualValues(t, 2500, count)
+
+			// Re-running a finished import reads nothing more
+			require.NoError(t, ProcessImport(context.Background(), &retry))
+			assert.Equal(t, 2500, retry.ProcessedRows)
+		})
+	}
+}
+
+// fakeS3 is an in-memory bucket standing in for S3: objects by key, and the keys of every PUT.
+// PUTs are denied while failPuts is set.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	puts     []string
+	failPuts bool
+}
+
+func (f *fakeS3) setFailPuts(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failPuts = fail
+}
+
+func (f *fakeS3) object(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.objects[key])
+}
+
+// setupTestS3 points common.S3Client at a fakeS3
+func setupTestS3(t *testing.T) *fakeS3 {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/test-bucket/")
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			if fake.failPuts {
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+				return
+			}
+			fake.objects[key] = body
+			fake.puts = append(fake.puts, key)
+		case http.MethodGet:
+			data, ok := fake.objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+				return
+			}
+			var start int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				io.WriteString(w, "<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message></Error>")
+				return
+			}
+			http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("S3_BUCKET", "test-bucket")
+	original := common.S3Client
+	common.S3Client = s3.New(s3.Options{
+		Region:                     "us-east-1",
+		BaseEndpoint:               aws.String(server.URL),
+		UsePathStyle:               true,
+		Credentials:                credentials.NewStaticCredentialsProvider("test", "test", ""),
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenRequired,
+	})
+	t.Cleanup(func() { common.S3Client = original })
+	return fake
+}
+
+// usersWithInvalidEmails is an NDJSON file of n users, every tenth one with an invalid email
+func usersWithInvalidEmails(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		email := fmt.Sprintf("user%d@example.com", i)
+		if i%10 == 0 {
+			email = fmt.Sprintf("not-an-email-%d", i)
+		}
+		fmt.Fprintf(&b, "{\"id\":\"uuid-%d\",\"email\":%q,\"username\":\"user%d\"}\n", i, email, i)
+	}
+	return b.String()
+}
+
+func TestProcessImport_ErrorReportSurvivesACrash(t *testing.T) {
+	db := setupTestDB(t)
+	bucket := setupTestS3(t)
+	data := usersWithInvalidEmails(2500)
+	bucket.objects["imports/users.ndjson"] = []byte(data)
+
+	job := &jobs.Job{ID: uuid.New(), Type: jobs.TypeImport, Resource: "users", Status: jobs.StatusProcessing,
+		WorkerID: "import-0", SourceKey: "imports/users.ndjson"}
+	require.NoError(t, db.Create(job).Error)
+
+	orig := jobs.ProgressFlushInterval
+	jobs.ProgressFlushInterval = 0
+	t.Cleanup(func() { jobs.ProgressFlushInterval = orig })
+
+	// First attempt stops after its first batch
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(jobs.ErrJobCancelled)
+	assert.ErrorIs(t, ProcessImport(ctx, job), jobs.ErrJobCancelled)
+	require.Positive(t, job.Checkpoint.FailedRows)
+	assert.Equal(t, []string{errorReportKey(job), errorReportKey(job)}, bucket.puts, "uploaded with the checkpoint, then when the attempt ended")
+
+	// The worker died instead: the row has the checkpoint but no result_key
+	var retry jobs.Job
+	require.NoError(t, db.First(&retry, "id = ?", job.ID).Error)
+	require.NotNil(t, retry.Checkpoint)
+	assert.Empty(t, retry.ResultKey)
+
+	require.NoError(t, ProcessImport(context.Background(), &retry))
+	assert.Equal(t, 250, retry.FailedRows)
+	assert.Equal(t, errorReportKey(job), retry.ResultKey)
+	report := strings.Split(strings.TrimSpace(bucket.object(retry.ResultKey)), "\n")
+	require.Len(t, report, 250, "rows rejected by both attempts")
+	var first RowError
+	require.NoError(t, json.Unmarshal([]byte(report[0]), &first))
+	assert.Equal(t, "uuid-0", first.ID)
+
+	// Resuming once everything is read still ends with the full report, the S3 InvalidRange included
+	retry.TotalBytes, retry.ResultKey = 0, ""
+	puts := len(bucket.puts)
+	require.NoError(t, ProcessImport(context.Background(), &retry))
+	assert.Len(t, bucket.puts, puts+1)
+	assert.Equal(t, 250, retry.FailedRows)
+	assert.Equal(t, 2250, retry.ProcessedRows)
+	assert.Equal(t, errorReportKey(job), retry.ResultKey)
+	assert.Len(t, strings.Split(strings.TrimSpace(bucket.object(retry.ResultKey)), "\n"), 250)
+}
+
+func TestProcessImport_KeepsCheckpointWhenTheReportCantBeUploaded(t *testing.T) {
+	db := setupTestDB(t)
+	bucket := setupTestS3(t)
+	bucket.objects["imports/users.ndjson"] = []byte(usersWithInvalidEmails(2500))
+
+	job := &jobs.Job{ID: uuid.New(), Type: jobs.TypeImport, Resource: "users", Status: jobs.StatusProcessing,
+		WorkerID: "import-0", SourceKey: "imports/users.ndjson"}
+	require.NoError(t, db.Create(job).Error)
+
+	orig := jobs.ProgressFlushInterval
+	jobs.ProgressFlushInterval = 0
+	t.Cleanup(func() { jobs.ProgressFlushInterval = orig })
+
+	// The first batch rejects rows, but the report can't be uploaded
+	bucket.setFailPuts(true)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(jobs.ErrJobCancelled)
+	assert.ErrorIs(t, ProcessImport(ctx, job), jobs.ErrJobCancelled)
+	assert.Positive(t, job.FailedRows)
+	assert.Nil(t, job.Checkpoint, "no checkpoint counts rows missing from the report")
+
+	var retry jobs.Job
+	require.NoError(t, db.First(&retry, "id = ?", job.ID).Error)
+	assert.Nil(t, retry.Checkpoint)
+
+	// The next attempt starts over, from zero like every attempt the worker runs, and its report
+	// has every rejected row
+	bucket.setFailPuts(false)
+	retry.ProcessedRows, retry.FailedRows, retry.InsertedRows, retry.UpdatedRows, retry.SkippedRows = 0, 0, 0, 0, 0
+	require.NoError(t, ProcessImport(context.Background(), &retry))
+	assert.Equal(t, 250, retry.FailedRows)
+	assert.Len(t, strings.Split(strings.TrimSpace(bucket.object(retry.ResultKey)), "\n"), 250)
+}
+
+func TestImportUsersCSV_DryRunMatchesRealImport(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, db.Create(&users.UserModel{Username: "old", Email: "user0@example.com", PasswordHash: "x", UUID: "old-uuid"}).Error)
+
+	// 1500 users, one of them already there, plus a duplicate within the first batch
+	data := strings.Replace(usersCSV(1500), "\n", "\nuuid-dup,user1@example.com,dup\n", 1)
+
+	var errs bytes.Buffer
+	dryRun := &jobs.Job{Resource: "users", Mode: jobs.ImportModeValidate}
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(strings.NewReader(data)), dryRun, json.NewEncoder(&errs)))
+	assert.Equal(t, 1499, dryRun.InsertedRows)
+	assert.Equal(t, 1, dryRun.UpdatedRows)
+	assert.Equal(t, 1, dryRun.FailedRows, "the email repeated within the batch")
+
+	var count int64
+	db.Model(&users.UserModel{}).Count(&count)
+	assert.EqualValues(t, 1, count, "a dry run writes nothing")
+	var old users.UserModel
+	db.First(&old, "email = ?", "user0@example.com")
+	assert.Equal(t, "old-uuid", old.UUID)
+
+	real := &jobs.Job{Resource: "users", Mode: jobs.ImportModeImport}
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(strings.NewReader(data)), real, json.NewEncoder(&errs)))
+	assert.Equal(t, dryRun.InsertedRows, real.InsertedRows)
+	assert.Equal(t, dryRun.UpdatedRows, real.UpdatedRows)
+	assert.Equal(t, dryRun.FailedRows, real.FailedRows)
+	assert.Equal(t, dryRun.ProcessedRows, real.ProcessedRows)
+	db.Model(&users.UserModel{}).Count(&count)
+	assert.EqualValues(t, 1500, count)
+}
+
+func TestImportArticles_DryRunLooksUpDependenciesWithoutWriting(t *testing.T) {
+	db := setupTestDB(t)
+	author := users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}
+	require.NoError(t, db.Create(&author).Error)
+	profile := articles.ArticleUserModel{UserModelID: author.ID}
+	require.NoError(t, db.Create(&profile).Error)
+	require.NoError(t, db.Create(&articles.ArticleModel{Slug: "existing", Title: "Existing", AuthorID: profile.ID, UUID: "article-1"}).Error)
+
+	data := strings.Join([]string{
+		`{"id":"article-1","slug":"existing","title":"Existing, edited","description":"d","body":"b","author_id":"author-1"}`,
+		`{"id":"article-2","slug":"new-one","title":"New one","description":"d","body":"b","author_id":"author-1","tagList":["go"]}`,
+		`{"id":"article-3","slug":"new-one","title":"New one again","description":"d","body":"b","author_id":"author-1"}`,
+		`{"id":"article-4","slug":"orphan","title":"Orphan","description":"d","body":"b","author_id":"nobody"}`,
+	}, "\n") + "\n"
+
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "articles", Mode: jobs.ImportModeValidate}
+	require.NoError(t, importArticlesJSON(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 2, job.UpdatedRows, "the existing slug, and the one the file itself would have inserted")
+	assert.Equal(t, 1, job.FailedRows)
+	assert.Contains(t, errs.String(), "Author not found: nobody")
+
+	var count int64
+	db.Model(&articles.ArticleModel{}).Count(&count)
+	assert.EqualValues(t, 1, count)
+	db.Model(&articles.TagModel{}).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestImportComments_DryRunCreatesNoAuthorProfile(t *testing.T) {
+	db := setupTestDB(t)
+	writer := users.UserModel{Username: "writer", Email: "writer@example.com", PasswordHash: "x", UUID: "user-1"}
+	require.NoError(t, db.Create(&writer).Error)
+	require.NoError(t, db.Create(&articles.ArticleModel{Slug: "a", Title: "A", UUID: "article-1"}).Error)
+
+	data := `{"id":"c1","article_id":"article-1","user_id":"user-1","body":"first"}
+{"id":"c2","article_id":"missing","user_id":"user-1","body":"second"}
+`
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "comments", Mode: jobs.ImportModeValidate}
+	require.NoError(t, importCommentsJSON(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 1, job.InsertedRows)
+	assert.Equal(t, 1, job.FailedRows)
+
+	var count int64
+	db.Model(&articles.CommentModel{}).Count(&count)
+	assert.Zero(t, count)
+	db.Model(&articles.ArticleUserModel{}).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestImport_OnConflictStrategies(t *testing.T) {
+	seed := func(t *testing.T, db *gorm.DB) {
+		author := users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}
+		require.NoError(t, db.Create(&author).Error)
+		profile := articles.ArticleUserModel{UserModelID: author.ID}
+		require.NoError(t, db.Create(&profile).Error)
+		article := articles.ArticleModel{Slug: "existing", Title: "Old title", AuthorID: profile.ID, UUID: "article-1"}
+		require.NoError(t, db.Create(&article).Error)
+		require.NoError(t, db.Create(&articles.CommentModel{Body: "old body", ArticleID: article.ID, AuthorID: profile.ID, UUID: "comment-1"}).Error)
+	}
+
+	usersData := "id,email,name\nauthor-1,author@example.com,renamed\nuser-2,new@example.com,newcomer\n"
+	articlesData := `{"id":"article-1","slug":"existing","title":"New title","description":"d","body":"b","author_id":"author-1"}
+{"id":"article-2","slug":"fresh","title":"Fresh","description":"d","body":"b","author_id":"author-1"}
+`
+	commentsData := `{"id":"comment-1","article_id":"article-1","user_id":"author-1","body":"new body"}
+{"id":"comment-2","article_id":"article-1","user_id":"author-1","body":"another"}
+`
+	current := func(db *gorm.DB, resource string) string {
+		switch resource {
+		case "users":
+			var u users.UserModel
+			db.First(&u, "email = ?", "author@example.com")
+			return u.Username
+		case "articles":
+			var a articles.ArticleModel
+			db.First(&a, "slug = ?", "existing")
+			return a.Title
+		}
+		var c articles.CommentModel
+		db.First(&c, "uuid = ?", "comment-1")
+		return c.Body
+	}
+
+	tests := []struct {
+		resource, data, strategy, want string
+		updated, skipped, failed       int
+	}{
+		{"users", usersData, jobs.ConflictUpdate, "renamed", 1, 0, 0},
+		{"users", usersData, jobs.ConflictSkip, "author", 0, 1, 0},
+		{"users", usersData, jobs.ConflictFail, "author", 0, 0, 1},
+		{"articles", articlesData, jobs.ConflictUpdate, "New title", 1, 0, 0},
+		{"articles", articlesData, jobs.ConflictSkip, "Old title", 0, 1, 0},
+		{"articles", articlesData, jobs.ConflictFail, "Old title", 0, 0, 1},
+		{"comments", commentsData, jobs.ConflictUpdate, "new body", 1, 0, 0},
+		{"comments", commentsData, jobs.ConflictSkip, "old body", 0, 1, 0},
+		{"comments", commentsData, jobs.ConflictFail, "old body", 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resource+"/"+tt.strategy, func(t *testing.T) {
+			db := setupTestDB(t)
+			seed(t, db)
+
+			var errs bytes.Buffer
+			job := &jobs.Job{Resource: tt.resource, OnConflict: tt.strategy}
+			src := newImportSource(strings.NewReader(tt.data))
+			var err error
+			switch tt.resource {
+			case "users":
+				err = importUsersCSV(context.Background(), src, job, json.NewEncoder(&errs))
+			case "articles":
+				err = importArticlesJSON(context.Background(), src, job, json.NewEncoder(&errs))
+			default:
+				err = importCommentsJSON(context.Background(), src, job, json.NewEncoder(&errs))
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, 1, job.InsertedRows, "the new row is inserted whatever the strategy")
+			assert.Equal(t, tt.updated, job.UpdatedRows)
+			assert.Equal(t, tt.skipped, job.SkippedRows)
+			assert.Equal(t, tt.failed, job.FailedRows)
+			if tt.failed > 0 {
+				assert.Contains(t, errs.String(), "CONFLICT")
+			}
+			assert.Equal(t, tt.want, current(db, tt.resource))
+		})
+	}
+}
+
+func TestImportUsers_CountsUsersCreatedMeanwhileAsSkipped(t *testing.T) {
+	for _, strategy := range []string{jobs.ConflictSkip, jobs.ConflictFail} {
+		t.Run(strategy, func(t *testing.T) {
+			db := setupTestDB(t)
+			// Someone signs up with one of the emails between the lookup and the insert
+			var once sync.Once
+			require.NoError(t, db.Callback().Create().Before("gorm:create").Register("sign_up", func(tx *gorm.DB) {
+				once.Do(func() {
+					require.NoError(t, tx.Session(&gorm.Session{NewDB: true}).Exec(
+						"INSERT INTO user_models (username, email, password, uuid) VALUES ('rival', 'b@example.com', 'x', 'rival-1')").Error)
+				})
+			}))
+
+			data := "id,email,name\nu1,a@example.com,alice\nu2,b@example.com,bobby\nu3,c@example.com,carol\n"
+			var errs bytes.Buffer
+			job := &jobs.Job{Resource: "users", OnConflict: strategy}
+			require.NoError(t, importUsersCSV(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+
+			assert.Equal(t, 2, job.InsertedRows)
+			assert.Equal(t, 1, job.SkippedRows)
+			assert.Equal(t, 2, job.ProcessedRows)
+			var rival users.UserModel
+			require.NoError(t, db.First(&rival, "email = ?", "b@example.com").Error)
+			assert.Equal(t, "rival", rival.Username, "the user created meanwhile is left alone")
+		})
+	}
+}
+
+func TestImport_RecordsEveryRejectedRow(t *testing.T) {
+	type entry struct {
+		Record, Line int
+		Code, Field  string
+	}
+	tests := []struct {
+		name, resource, data string
+		processed, lines     int
+		want                 []entry
+	}{
+		{
+			name:     "csv",
+			resource: "users",
+			data: "id,email,name\n" +
+				"u1,a@example.com,alice\n" +
+				"u2,,bobby\n" +
+				",c@example.com,carol\n" +
+				"u4,a@example.com,alice2\n" +
+				"u5,\"two\nlines\",erin,extra\n" +
+				"u6,f@example.com,frank\n",
+			processed: 2,
+			lines:     8,
+			want: []entry{
+				{2, 3, "MISSING_FIELD", "email"},
+				{3, 4, "MISSING_FIELD", "id"},
+				{4, 5, "DUPLICATE", "email"},
+				{5, 6, "PARSE_ERROR", ""},
+			},
+		},
+		{
+			name:     "ndjson",
+			resource: "users",
+			data: `{"id":"u1","email":"a@example.com","username":"alice"}` + "\n\n" +
+				"not json\n" +
+				`{"id":"u3","email":5}` + "\n" +
+				`{"id":"u4","username":"dave"}` + "\n",
+			processed: 1,
+			lines:     5,
+			want: []entry{
+				{2, 3, "PARSE_ERROR", ""},
+				{3, 4, "PARSE_ERROR", "email"},
+				{4, 5, "MISSING_FIELD", "email"},
+			},
+		},
+		{
+			name:     "json array",
+			resource: "articles",
+			data: `[{"id":"a1","title":"One!","description":"d","body":"b","author_id":"author-1"},
+ {"id":"a2","description":"d","body":"b","author_id":"author-1"},
+ {"id":"a3","title":"Three","description":"d","body":"b","author_id":"nobody"},
+ {"id":"a4", oops}]`,
+			processed: 1,
+			want: []entry{
+				{2, 0, "MISSING_FIELD", "title"},
+				{3, 0, "DEPENDENCY_ERROR", "author_id"},
+				{4, 0, "PARSE_ERROR", ""},
+			},
+		},
+		{
+			name:     "comments",
+			resource: "comments",
+			data: `{"id":"c1","article_id":"article-1","user_id":"author-1","body":"ok"}
+{"id":"c1","article_id":"article-1","user_id":"author-1","body":"again"}
+{"id":"c3","article_id":"missing","user_id":"author-1","body":"orphan"}
+{"id":"c4","article_id":"article-1","user_id":"author-1"}
+`,
+			processed: 1,
+			lines:     4,
+			want: []entry{
+				{2, 2, "DUPLICATE", "id"},
+				{3, 3, "DEPENDENCY_ERROR", "article_id"},
+				{4, 4, "MISSING_FIELD", "body"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			require.NoError(t, db.Create(&users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}).Error)
+			require.NoError(t, db.Create(&articles.ArticleModel{Slug: "a", Title: "A", UUID: "article-1"}).Error)
+
+			var errs bytes.Buffer
+			job := &jobs.Job{Resource: tt.resource}
+			src := newImportSource(strings.NewReader(tt.data))
+			var err error
+			switch {
+			case tt.name == "csv":
+				err = importUsersCSV(context.Background(), src, job, json.NewEncoder(&errs))
+			case tt.resource == "users":
+				err = importUsersNDJSON(context.Background(), src, job, json.NewEncoder(&errs))
+			case tt.resource == "articles":
+				err = importArticlesJSON(context.Background(), src, job, json.NewEncoder(&errs))
+			default:
+				err = importCommentsJSON(context.Background(), src, job, json.NewEncoder(&errs))
+			}
+			require.NoError(t, err)
+
+			var got []entry
+			decoder := json.NewDecoder(&errs)
+			for decoder.More() {
+				var e RowError
+				require.NoError(t, decoder.Decode(&e))
+				assert.NotEmpty(t, e.Message)
+				if e.Code != "PARSE_ERROR" || tt.name != "json array" {
+					assert.NotEmpty(t, e.Raw, "record %d", e.Record)
+				}
+				got = append(got, entry{e.Record, e.Line, e.Code, e.Field})
+			}
+			assert.Equal(t, tt.want, got)
+
+			assert.Equal(t, tt.processed, job.ProcessedRows)
+			assert.Equal(t, len(tt.want), job.FailedRows)
+			assert.Equal(t, tt.lines, job.Checkpoint.Line)
+			assert.Equal(t, job.Checkpoint.Record, job.ProcessedRows+job.FailedRows+job.SkippedRows, "every record read is accounted for")
+		})
+	}
+}
+
+func TestImport_ValidatesRowsLikeTheAPI(t *testing.T) {
+	db := setupTestDB(t)
+	image := "https://example.com/kept.png"
+	require.NoError(t, db.Create(&users.UserModel{Username: "keeper", Email: "keep@example.com", PasswordHash: "x", UUID: "u0", Bio: "kept", Image: &image}).Error)
+
+	data := "id,email,name,bio,image\n" +
+		"u0,keep@example.com,keeper2,,\n" +
+		"u1,not-an-email,alice,,\n" +
+		"u2,b@example.com,bob,,\n" +
+		"u3,c@example.com,carol," + strings.Repeat("x", 1025) + ",not a url\n" +
+		"u4,d@example.com,dave,Hello,https://example.com/d.png\n"
+
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "users"}
+	require.NoError(t, importUsersCSV(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 2, job.ProcessedRows)
+	assert.Equal(t, 3, job.FailedRows)
+
+	var entries []RowError
+	decoder := json.NewDecoder(&errs)
+	for decoder.More() {
+		var e RowError
+		require.NoError(t, decoder.Decode(&e))
+		entries = append(entries, e)
+	}
+	require.Len(t, entries, 3)
+	assert.Equal(t, "email", entries[0].Field)
+	assert.Equal(t, map[string]string{"email": "{key: email}"}, entries[0].Errors)
+	assert.Equal(t, map[string]string{"username": "{min: 4}"}, entries[1].Errors)
+	assert.Equal(t, map[string]string{"bio": "{max: 1024}", "image": "{key: url}"}, entries[2].Errors)
+	for _, e := range entries {
+		assert.Equal(t, "VALIDATION_ERROR", e.Code)
+	}
+
+	var imported users.UserModel
+	require.NoError(t, db.First(&imported, "email = ?", "d@example.com").Error)
+	assert.Equal(t, "Hello", imported.Bio)
+	require.NotNil(t, imported.Image)
+	assert.Equal(t, "https://example.com/d.png", *imported.Image)
+
+	// A file without a profile doesn't wipe the existing one
+	var updated users.UserModel
+	require.NoError(t, db.First(&updated, "email = ?", "keep@example.com").Error)
+	assert.Equal(t, "keeper2", updated.Username)
+	assert.Equal(t, "kept", updated.Bio)
+	require.NotNil(t, updated.Image)
+	assert.Equal(t, image, *updated.Image)
+
+	// Articles and comments follow their validators too
+	author := users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}
+	require.NoError(t, db.Create(&author).Error)
+	require.NoError(t, db.Create(&articles.ArticleModel{Slug: "a", Title: "A", UUID: "article-1"}).Error)
+
+	errs.Reset()
+	job = &jobs.Job{Resource: "articles"}
+	articlesData := `{"id":"a1","title":"Hi","description":"d","body":"` + strings.Repeat("x", 2049) + `","author_id":"author-1"}` + "\n"
+	require.NoError(t, importArticlesJSON(context.Background(), newImportSource(strings.NewReader(articlesData)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 1, job.FailedRows)
+	var article RowError
+	require.NoError(t, json.Unmarshal(errs.Bytes(), &article))
+	assert.Equal(t, "title", article.Field)
+	assert.Equal(t, map[string]string{"title": "{min: 4}", "body": "{max: 2048}"}, article.Errors)
+
+	errs.Reset()
+	job = &jobs.Job{Resource: "comments"}
+	commentsData := `{"id":"c1","article_id":"article-1","user_id":"author-1","body":"` + strings.Repeat("x", 2049) + `"}` + "\n"
+	require.NoError(t, importCommentsJSON(context.Background(), newImportSource(strings.NewReader(commentsData)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 1, job.FailedRows)
+	assert.Contains(t, errs.String(), `"field":"body"`)
+}
+
+// export exports every record of a resource, leaving out the given fields
+func export(t *testing.T, resource, format string, without ...string) string {
+	opts := ExportOptions{Format: format}
+	if len(without) > 0 {
+		for _, field := range recordFields[resource] {
+			if !slices.Contains(without, field) {
+				opts.Fields = append(opts.Fields, field)
+			}
+		}
+	}
+	var out bytes.Buffer
+	_, err := StreamExport(context.Background(), resource, opts, &out)
+	require.NoError(t, err)
+	return out.String()
+}
+
+func TestProcessImport_RoundTripsEveryExportFormat(t *testing.T) {
+	for _, format := range []string{"csv", "ndjson", "json"} {
+		t.Run(format, func(t *testing.T) {
+			db := setupTestDB(t)
+			image := "https://example.com/ann.png"
+			ann := users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1", Bio: "Writes, \"mostly\"", Image: &image}
+			bob := users.UserModel{Username: "bobby", Email: "bob@example.com", PasswordHash: "x"} // Created like the API does, without a UUID
+			require.NoError(t, db.Create(&ann).Error)
+			require.NoError(t, db.Create(&bob).Error)
+			annProfile := articles.ArticleUserModel{UserModelID: ann.ID}
+			bobProfile := articles.ArticleUserModel{UserModelID: bob.ID}
+			require.NoError(t, db.Create(&annProfile).Error)
+			require.NoError(t, db.Create(&bobProfile).Error)
+			first := articles.ArticleModel{Slug: "first", Title: "First post", Description: "Intro", Body: "Line one\nline two, with a comma", AuthorID: annProfile.ID, UUID: "article-1"}
+			second := articles.ArticleModel{Slug: "second", Title: "Second post", Description: "More", Body: "Body", AuthorID: bobProfile.ID}
+			first.CreatedAt = time.Date(2025, 11, 3, 9, 30, 0, 0, time.UTC)
+			first.UpdatedAt = time.Date(2026, 1, 14, 17, 5, 0, 0, time.UTC)
+			require.NoError(t, db.Create(&first).Error)
+			require.NoError(t, db.Create(&second).Error)
+			require.NoError(t, db.Model(&first).Association("Tags").Append([]articles.TagModel{{Tag: "go"}, {Tag: "web"}, {Tag: "c|c++"}, {Tag: `back\slash`}}))
+			created := time.Date(2026, 2, 5, 12, 0, 0, 0, time.UTC)
+			for i, c := range []articles.CommentModel{
+				{Body: "Nice", ArticleID: first.ID, AuthorID: bobProfile.ID, UUID: "comment-1"},
+				{Body: "Thanks,\nBob", ArticleID: first.ID, AuthorID: annProfile.ID},
+				{Body: "Agreed", ArticleID: second.ID, AuthorID: annProfile.ID, UUID: "comment-3"},
+			} {
+				c.CreatedAt = created.Add(time.Duration(i) * time.Minute)
+				require.NoError(t, db.Create(&c).Error)
+			}
+
+			exported := make(map[string]string)
+			for _, resource := range []string{"users", "articles", "comments"} {
+				exported[resource] = export(t, resource, format)
+			}
+			articlesAsOf := export(t, "articles", format, "updated_at")
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resource := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "."+format)
+				http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(exported[resource]))
+			}))
+			defer server.Close()
+
+			setupTestDB(t)
+			for _, step := range []struct {
+				resource string
+				rows     int
+			}{{"users", 2}, {"articles", 2}, {"comments", 3}} {
+				resource := step.resource
+				job := &jobs.Job{ID: uuid.New(), Resource: resource, SourceKey: server.URL + "/" + resource + "." + format}
+				require.NoError(t, ProcessImport(context.Background(), job))
+				assert.Zero(t, job.FailedRows, resource)
+				assert.Equal(t, step.rows, job.InsertedRows, resource)
+				if resource == "articles" {
+					// Imported articles are updated now, whatever the file says
+					assert.Equal(t, articlesAsOf, export(t, resource, format, "updated_at"), resource)
+					var imported articles.ArticleModel
+					require.NoError(t, common.GetDB().Preload("Tags").First(&imported, "slug = ?", "first").Error)
+					var tags []string
+					for _, tag := range imported.Tags {
+						tags = append(tags, tag.Tag)
+					}
+					assert.ElementsMatch(t, []string{"go", "web", "c|c++", `back\slash`}, tags, "tags survive the round trip")
+					continue
+				}
+				assert.Equal(t, exported[resource], export(t, resource, format), resource)
+			}
+		})
+	}
+}
+
+func TestImport_RejectsUnsupportedSchemaVersions(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name, data string
+		importer   func(context.Context, *importSource, *jobs.Job, *json.Encoder) error
+		code       string
+	}{
+		{"newer version", `{"id":"u1","username":"annie","email":"ann@example.com","schema_version":2}` + "\n", importUsersNDJSON, "UNSUPPORTED_VERSION"},
+		{"not a number", "id,username,email,schema_version\nu1,annie,ann@example.com,v1\n", importUsersCSV, "PARSE_ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errs bytes.Buffer
+			job := &jobs.Job{Resource: "users"}
+			require.NoError(t, tt.importer(context.Background(), newImportSource(strings.NewReader(tt.data)), job, json.NewEncoder(&errs)))
+			assert.Zero(t, job.ProcessedRows)
+			require.Equal(t, 1, job.FailedRows)
+
+			var entry RowError
+			require.NoError(t, json.Unmarshal(errs.Bytes(), &entry))
+			assert.Equal(t, tt.code, entry.Code)
+			assert.Equal(t, "schema_version", entry.Field)
+		})
+	}
+}
+
+func TestImportArticlesCSV_ReadsTagsFromOneColumn(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, db.Create(&users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}).Error)
+
+	data := "\ufeffID,Slug,Title,Description,Body,Author_ID,tagList\n" +
+		"article-1,tagged,Tagged post,d,b,author-1,go | web||gin\n" +
+		"article-2,untagged,Untagged post,d,b,author-1,\n"
+
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "articles"}
+	require.NoError(t, importArticlesCSV(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 2, job.InsertedRows, errs.String())
+
+	var article articles.ArticleModel
+	require.NoError(t, db.Preload("Tags").First(&article, "slug = ?", "tagged").Error)
+	var tags []string
+	for _, tag := range article.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	assert.ElementsMatch(t, []string{"go", "web", "gin"}, tags)
+	assert.Equal(t, 3, job.Checkpoint.Line)
+}
+
+func TestJoinTags_EscapesTheSeparator(t *testing.T) {
+	tags := []string{"go", "c|c++", `back\slash`, `trailing\`}
+	field := joinTags(tags)
+	assert.Equal(t, `go|c\|c++|back\\slash|trailing\\`, field)
+	assert.Equal(t, tags, splitTags(field))
+}
+
+func TestStreamExport_ExpandsArticlesWithOneQueryPerExpansion(t *testing.T) {
+	db := setupTestDB(t)
+	image := "https://example.com/ann.png"
+	ann := users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1", Bio: "Writer", Image: &image}
+	require.NoError(t, db.Create(&ann).Error)
+	author := articles.ArticleUserModel{UserModelID: ann.ID}
+	require.NoError(t, db.Create(&author).Error)
+	tagged := articles.ArticleModel{Slug: "tagged", Title: "Tagged", Description: "d", Body: "b", AuthorID: author.ID, UUID: "article-1",
+		Tags: []articles.TagModel{{Tag: "web"}, {Tag: "go"}}}
+	plain := articles.ArticleModel{Slug: "plain", Title: "Plain", Description: "d", Body: "b", AuthorID: author.ID, UUID: "article-2"}
+	require.NoError(t, db.Create(&tagged).Error)
+	require.NoError(t, db.Create(&plain).Error)
+	created := time.Date(2026, 2, 5, 12, 0, 0, 0, time.UTC)
+	comment := articles.CommentModel{Body: "Nice", ArticleID: tagged.ID, AuthorID: author.ID, UUID: "comment-1"}
+	comment.CreatedAt = created
+	require.NoError(t, db.Create(&comment).Error)
+	require.NoError(t, db.Create(&articles.FavoriteModel{FavoriteID: tagged.ID, FavoriteByID: author.ID}).Error)
+
+	queries := 0
+	count := func(*gorm.DB) { queries++ }
+	require.NoError(t, db.Callback().Query().After("gorm:query").Register("count_queries", count))
+	require.NoError(t, db.Callback().Row().After("gorm:row").Register("count_queries", count))
+
+	expand := []string{jobs.ExpandTags, jobs.ExpandAuthor, jobs.ExpandComments, jobs.ExpandFavoritesCount}
+	var out bytes.Buffer
+	rows, err := StreamExport(context.Background(), "articles", ExportOptions{Format: "ndjson", Expand: expand}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rows)
+	assert.Equal(t, 4, queries, "the page, then its tags, comments and favorites") // Authors come with the page
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var first, second map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, []interface{}{"go", "web"}, first["tagList"])
+	assert.Equal(t, map[string]interface{}{"id": "user-1", "username": "annie", "bio": "Writer", "image": image}, first["author"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": "comment-1", "body": "Nice", "author_id": "user-1", "created_at": "2026-02-05T12:00:00Z"}}, first["comments"])
+	assert.EqualValues(t, 1, first["comments_count"])
+	assert.EqualValues(t, 1, first["favorites_count"])
+	assert.Equal(t, []interface{}{}, second["tagList"])
+	assert.Equal(t, []interface{}{}, second["comments"])
+	assert.EqualValues(t, 0, second["favorites_count"])
+
+	out.Reset()
+	_, err = StreamExport(context.Background(), "articles", ExportOptions{Format: "csv", Expand: expand}, &out)
+	require.NoError(t, err)
+	exported := out.String()
+	records, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, append(slices.Clone(recordFields["articles"]),
+		"author_username", "author_bio", "author_image", "comments_count", "favorites_count"), records[0])
+	tagList := len(recordFields["articles"]) - 1
+	assert.Equal(t, []string{"go|web", "annie", "Writer", image, "1", "1"}, records[1][tagList:])
+	assert.Equal(t, []string{"", "annie", "Writer", image, "0", "0"}, records[2][tagList:])
+
+	// Expanded exports still import, tags included
+	db = setupTestDB(t)
+	require.NoError(t, db.Create(&users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1"}).Error)
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "articles"}
+	require.NoError(t, importArticlesCSV(context.Background(), newImportSource(strings.NewReader(exported)), job, json.NewEncoder(&errs)))
+	assert.Equal(t, 2, job.InsertedRows, errs.String())
+	var imported articles.ArticleModel
+	require.NoError(t, db.Preload("Tags").First(&imported, "slug = ?", "tagged").Error)
+	assert.Len(t, imported.Tags, 2)
+}
+
+func TestStreamExport_ProjectsFields(t *testing.T) {
+	db := setupTestDB(t)
+	ann := users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1"}
+	require.NoError(t, db.Create(&ann).Error)
+	author := articles.ArticleUserModel{UserModelID: ann.ID}
+	require.NoError(t, db.Create(&author).Error)
+	require.NoError(t, db.Create(&articles.ArticleModel{Slug: "tagged", Title: "Tagged", Description: "d", Body: "b", AuthorID: author.ID, UUID: "article-1",
+		Tags: []articles.TagModel{{Tag: "go"}}}).Error)
+
+	tests := []struct {
+		name, resource, format string
+		fields                 []string
+		want                   string
+	}{
+		{"csv columns picked, ordered and renamed", "users", "csv", []string{"email:mail, id", "username:login"},
+			"mail,id,login\nann@example.com,user-1,annie\n"},
+		{"json keys in order", "users", "ndjson", []string{"username", "id:user_id"},
+			`{"username":"annie","user_id":"user-1"}` + "\n"},
+		{"expansion fields bring their expansion", "articles", "json", []string{"slug,tagList:tags"},
+			`[{"slug":"tagged","tags":["go"]}` + "\n]"},
+		{"flattened expansion fields", "articles", "csv", []string{"slug,author_username"},
+			"slug,author_username\ntagged,annie\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, ValidateFields(tt.resource, tt.format, nil, tt.fields))
+			var out bytes.Buffer
+			_, err := StreamExport(context.Background(), tt.resource, ExportOptions{Format: tt.format, Fields: tt.fields}, &out)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
+
+func TestValidateFields_RejectsBadFields(t *testing.T) {
+	tests := []struct {
+		resource, format string
+		fields           []string
+		err              string
+	}{
+		{"users", "csv", []string{"id,password"}, `unknown field "password", use: id, username, email, bio, image, schema_version`},
+		{"comments", "ndjson", []string{"tagList"}, `unknown field "tagList", use: id, body, article_id, author_id, created_at, schema_version`},
+		{"articles", "ndjson", []string{"author_username"}, `unknown field "author_username", use: id, slug, title, description, body, created_at, updated_at, author_id, schema_version, tagList, author, comments, comments_count, favorites_count`},
+		{"users", "csv", []string{"id:"}, `field "id" has an empty alias`},
+		{"users", "csv", []string{"id,email:id"}, `field "id" appears more than once`},
+	}
+	for _, tt := range tests {
+		assert.EqualError(t, ValidateFields(tt.resource, tt.format, nil, tt.fields), tt.err)
+	}
+
+	// StreamExport rejects them for good, a retry wouldn't fix them
+	_, err := StreamExport(context.Background(), "users", ExportOptions{Format: "csv", Fields: []string{"password"}}, io.Discard)
+	assert.False(t, jobs.IsRetryable(err))
+}
+
+func TestStreamExport_FiltersArticles(t *testing.T) {
+	db := setupTestDB(t)
+	var authors []articles.ArticleUserModel
+	for _, name := range []string{"john", "jane"} {
+		user := users.UserModel{Username: name, Email: name + "@example.com", PasswordHash: "x", UUID: "user-" + name}
+		require.NoError(t, db.Create(&user).Error)
+		author := articles.ArticleUserModel{UserModelID: user.ID}
+		require.NoError(t, db.Create(&author).Error)
+		authors = append(authors, author)
+	}
+	john, jane := authors[0], authors[1]
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 10, 0, 0, 0, time.UTC) }
+	for _, a := range []struct {
+		slug, title string
+		author      articles.ArticleUserModel
+		tags        []string
+		created     time.Time
+	}{
+		{"go-intro", "Intro to Go", john, []string{"go"}, day(5)},
+		{"web-100%", "Web, 100% done", jane, []string{"web", "go"}, day(10)},
+		{"draft", "Draft: gin", jane, nil, day(20)},
+	} {
+		article := articles.ArticleModel{Slug: a.slug, Title: a.title, Description: "d", Body: "b", AuthorID: a.author.ID}
+		article.CreatedAt, article.UpdatedAt = a.created, a.created
+		for _, tag := range a.tags {
+			var model articles.TagModel
+			require.NoError(t, db.FirstOrCreate(&model, articles.TagModel{Tag: tag}).Error)
+			article.Tags = append(article.Tags, model)
+		}
+		require.NoError(t, db.Create(&article).Error)
+		if a.slug == "draft" {
+			// john favorited the draft
+			require.NoError(t, db.Create(&articles.FavoriteModel{FavoriteID: article.ID, FavoriteByID: john.ID}).Error)
+		}
+	}
+
+	tests := []struct {
+		filter  string
+		filters map[string]string
+		want    []string
+	}{
+		{"", nil, []string{"go-intro", "web-100%", "draft"}},
+		{"tag = go", nil, []string{"go-intro", "web-100%"}},
+		{"tag != go", nil, []string{"draft"}},
+		{"tag IN (web, gin)", nil, []string{"web-100%"}},
+		{"author = john OR favorited = john", nil, []string{"go-intro", "draft"}},
+		{"created_at >= 2026-01-10 AND created_at < 2026-01-20T00:00:00Z", nil, []string{"web-100%"}},
+		{"created_at = 2026-01-05", nil, []string{"go-intro"}},
+		{"created_at > 2026-01-10", nil, []string{"draft"}},
+		{"title CONTAINS \"100%\"", nil, []string{"web-100%"}},
+		{"title contains GO", nil, []string{"go-intro"}},
+		{"NOT (tag = go AND author = jane) and slug != draft", nil, []string{"go-intro"}},
+		{"tag = go", map[string]string{"author": "jane"}, []string{"web-100%"}},
+		{"", map[string]string{"author": "nobody"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			opts := ExportOptions{Format: "ndjson", Filter: tt.filter, Filters: tt.filters, Fields: []string{"slug"}}
+			var out bytes.Buffer
+			rows, err := StreamExport(context.Background(), "articles", opts, &out)
+			require.NoError(t, err)
+			var slugs []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var record struct{ Slug string }
+				if line != "" {
+					require.NoError(t, json.Unmarshal([]byte(line), &record))
+					slugs = append(slugs, record.Slug)
+				}
+			}
+			assert.Equal(t, tt.want, slugs)
+
+			// Counting uses the same filter
+			count, err := CountExport("articles", opts)
+			require.NoError(t, err)
+			assert.EqualValues(t, rows, count)
+		})
+	}
+}
+
+func TestParseFilter_RejectsBadFilters(t *testing.T) {
+	tests := []struct {
+		resource, filter string
+		filters          map[string]string
+		err              string
+	}{
+		{"articles", "", map[string]string{"status": "published"}, `filter: unknown field "status" for articles, use: author, author_id, body, created_at, description, favorited, id, slug, tag, title, updated_at`},
+		{"users", "tag = go", nil, `filter: unknown field "tag" for users, use: bio, email, id, username`},
+		{"articles", "tag go", nil, `filter: expected an operator after tag at position 5, got "go"`},
+		{"articles", "tag =", nil, `filter: expected a value after = at position 6, got end of filter`},
+		{"articles", "(tag = go", nil, `filter: expected ")" at position 10, got end of filter`},
+		{"articles", "tag = go title = x", nil, `filter: unexpected "title" at position 10`},
+		{"articles", "tag IN (go web)", nil, `filter: expected ")" at position 12, got "web"`},
+		{"articles", "title > b", nil, `filter: title can't be compared with >`},
+		{"articles", "created_at CONTAINS 2026", nil, `filter: created_at can't be compared with CONTAINS`},
+		{"articles", "created_at >= yesterday", nil, `filter: created_at must be an RFC3339 timestamp or a date (YYYY-MM-DD), got "yesterday"`},
+		{"articles", `title = "open`, nil, `filter: unterminated string starting at position 9`},
+		{"articles", "! tag = go", nil, `filter: unexpected '!' at position 1, use != or NOT`},
+		{"articles", "AND tag = go", nil, `filter: expected a field at position 1, got "AND"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.resource, tt.filter, tt.filters)
+		assert.EqualError(t, err, tt.err, tt.filter)
+	}
+}
+
+func TestStreamExport_IncrementalExportsChangesSince(t *testing.T) {
+	db := setupTestDB(t)
+	user := users.UserModel{Username: "john", Email: "john@example.com", PasswordHash: "x", UUID: "user-john"}
+	require.NoError(t, db.Create(&user).Error)
+	author := articles.ArticleUserModel{UserModelID: user.ID}
+	require.NoError(t, db.Create(&author).Error)
+
+	since := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	before, after := since.Add(-time.Hour), since.Add(time.Hour)
+	for _, a := range []struct {
+		slug             string
+		created, updated time.Time
+		deleted          *time.Time
+	}{
+		{"unchanged", before, before, nil},
+		{"updated", before, after, nil},
+		{"created", after, after, nil},
+		{"deleted", before, before, &after},
+		{"deleted-long-ago", before, before, &before},
+	} {
+		article := articles.ArticleModel{Slug: a.slug, Title: a.slug, Description: "d", Body: "b", AuthorID: author.ID, UUID: "article-" + a.slug}
+		article.CreatedAt, article.UpdatedAt = a.created, a.updated
+		if a.deleted != nil {
+			article.DeletedAt = gorm.DeletedAt{Time: *a.deleted, Valid: true}
+		}
+		require.NoError(t, db.Create(&article).Error)
+	}
+
+	opts := ExportOptions{Format: "ndjson", Since: &since, Fields: []string{"id", "slug"}, Expand: []string{jobs.ExpandTags}}
+	var out bytes.Buffer
+	rows, err := StreamExport(context.Background(), "articles", opts, &out)
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":"article-updated","slug":"updated","deleted_at":null}
+{"id":"article-created","slug":"created","deleted_at":null}
+{"id":"article-deleted","slug":null,"deleted_at":"2026-02-01T01:00:00Z"}
+`, out.String())
+
+	count, err := CountExport("articles", opts)
+	require.NoError(t, err)
+	assert.EqualValues(t, rows, count)
+
+	// CSV tombstones leave every column but the id and deleted_at empty
+	out.Reset()
+	opts.Format, opts.Fields = "csv", []string{"id", "slug", "schema_version"}
+	_, err = StreamExport(context.Background(), "articles", opts, &out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "article-deleted,,1,2026-02-01T01:00:00Z\n")
+
+	// A full export leaves the deleted articles out
+	count, err = CountExport("articles", ExportOptions{Format: "ndjson"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, count)
+}
+
+func TestImportArticles_ShowUpInTheNextIncrementalExport(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, db.Create(&users.UserModel{Username: "author", Email: "author@example.com", PasswordHash: "x", UUID: "author-1"}).Error)
+
+	since := time.Now().Add(-time.Second)
+	data := `{"id":"article-1","slug":"old-post","title":"Old post","description":"d","body":"b","author_id":"author-1","created_at":"2020-01-01T00:00:00Z","updated_at":"2020-01-02T00:00:00Z"}` + "\n"
+	var errs bytes.Buffer
+	job := &jobs.Job{Resource: "articles"}
+	require.NoError(t, importArticlesJSON(context.Background(), newImportSource(strings.NewReader(data)), job, json.NewEncoder(&errs)))
+	require.Equal(t, 1, job.InsertedRows, errs.String())
+
+	var article articles.ArticleModel
+	require.NoError(t, db.First(&article, "slug = ?", "old-post").Error)
+	assert.True(t, article.CreatedAt.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), "created_at comes from the file")
+	assert.True(t, article.UpdatedAt.After(since), "updated_at is the time of the import")
+
+	count, err := CountExport("articles", ExportOptions{Format: "ndjson", Since: &since})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, count)
+}
+
+func TestResolveSince(t *testing.T) {
+	startedAt := time.Date(2026, 2, 1, 10, 30, 0, 123456789, time.UTC)
+	cursor := NextCursor("articles", startedAt)
+	since, err := ResolveSince("articles", nil, cursor)
+	require.NoError(t, err)
+	assert.Equal(t, startedAt.Add(-CursorOverlap).Truncate(time.Microsecond), *since, "overlaps the rows committed after the snapshot")
+
+	since, err = ResolveSince("comments", &startedAt, "")
+	require.NoError(t, err)
+	assert.Equal(t, startedAt, *since)
+
+	since, err = ResolveSince("users", nil, "")
+	require.NoError(t, err)
+	assert.Nil(t, since)
+	assert.Empty(t, NextCursor("users", startedAt))
+
+	_, err = ResolveSince("comments", nil, cursor)
+	assert.EqualError(t, err, "cursor belongs to an export of articles, not comments")
+	_, err = ResolveSince("articles", nil, "not-a-cursor")
+	assert.EqualError(t, err, "invalid cursor")
+	_, err = ResolveSince("articles", &startedAt, cursor)
+	assert.EqualError(t, err, "use either since or cursor, not both")
+	_, err = ResolveSince("users", &startedAt, "")
+	assert.EqualError(t, err, "incremental exports are only supported for articles and comments")
+}
+
+func TestStreamExport_ReadsOneSnapshot(t *testing.T) {
+	db := setupTestDB(t)
+	user := users.UserModel{Username: "john", Email: "john@example.com", PasswordHash: "x", UUID: "user-john"}
+	require.NoError(t, db.Create(&user).Error)
+	author := articles.ArticleUserModel{UserModelID: user.ID}
+	require.NoError(t, db.Create(&author).Error)
+	article := articles.ArticleModel{Slug: "go-intro", Title: "Intro", Description: "d", Body: "b", AuthorID: author.ID}
+	require.NoError(t, db.Create(&article).Error)
+	require.NoError(t, db.Create(&articles.FavoriteModel{FavoriteID: article.ID, FavoriteByID: author.ID}).Error)
+
+	before := time.Now().Truncate(time.Second) // SQLite's CURRENT_TIMESTAMP has no fractional seconds
+	snapshot, snapshotAt, err := BeginSnapshot(db)
+	require.NoError(t, err)
+	defer snapshot.Rollback()
+	assert.False(t, snapshotAt.Before(before))
+	assert.WithinDuration(t, time.Now(), snapshotAt, 2*time.Second)
+
+	// Every query, expansions included, goes through the snapshot: with a single connection, one
+	// going to the database directly would wait for the transaction forever
+	opts := ExportOptions{Format: "ndjson", Expand: []string{jobs.ExpandFavoritesCount}, Fields: []string{"slug", "favorites_count"}, DB: snapshot}
+	count, err := CountExport("articles", opts)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	rows, err := StreamExport(context.Background(), "articles", opts, &out)
+	require.NoError(t, err)
+	assert.EqualValues(t, count, rows)
+	assert.Equal(t, "{\"slug\":\"go-intro\",\"favorites_count\":1}\n", out.String())
+}
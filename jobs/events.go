@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// JobUpdate is a snapshot of a job's status and counters, published whenever a batch is flushed
+// or the job changes status
+type JobUpdate struct {
+	ID            uuid.UUID
+	Status        string
+	TotalRows     int
+	ProcessedRows int
+	FailedRows    int
+	SkippedRows   int
+	Finished      bool // Final status, and the worker (if any) is done with the job
+}
+
+// EventPollInterval is how often GET /v1/jobs/:id/events re-reads the job row, to pick up
+// changes made by other instances (the reaper, workers elsewhere...)
+var EventPollInterval = 5 * time.Second
+
+// ProgressFlushInterval throttles how often a running import writes its counters to the job row
+var ProgressFlushInterval = 2 * time.Second
+
+// IsFinal reports whether a job in this status will never run again
+func IsFinal(status string) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusCancelled, StatusDeadLetter:
+		return true
+	}
+	return false
+}
+
+// EventBroker fans job updates out to the clients following a job within this process.
+// Updates from workers on other instances reach those clients through a slower DB poll.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan JobUpdate]struct{}
+}
+
+var broker = NewEventBroker()
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[uuid.UUID]map[chan JobUpdate]struct{})}
+}
+
+// Publish delivers update to every subscriber of the job without ever blocking the caller.
+// A subscriber that is behind skips intermediate updates and catches up on the next one.
+func (b *EventBroker) Publish(update JobUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[update.ID] {
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
+
+// Subscribe follows the updates of one job until unsubscribe is called
+func (b *EventBroker) Subscribe(id uuid.UUID) (updates <-chan JobUpdate, unsubscribe func()) {
+	ch := make(chan JobUpdate, 16)
+	b.mu.Lock()
+	if b.subscribers[id] == nil {
+		b.subscribers[id] = make(map[chan JobUpdate]struct{})
+	}
+	b.subscribers[id][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[id], ch)
+		if len(b.subscribers[id]) == 0 {
+			delete(b.subscribers, id)
+		}
+	}
+}
+
+func GetEventBroker() *EventBroker {
+	return broker
+}
+
+// PublishProgress announces the current status and counters of a job
+func PublishProgress(job *Job) {
+	broker.Publish(job.Update())
+}
+
+// Update takes a snapshot of the job's status and counters
+func (j *Job) Update() JobUpdate {
+	return JobUpdate{
+		ID:            j.ID,
+		Status:        j.Status,
+		TotalRows:     j.TotalRows,
+		ProcessedRows: j.ProcessedRows,
+		FailedRows:    j.FailedRows,
+		SkippedRows:   j.SkippedRows,
+		Finished:      IsFinal(j.Status) && j.FinishedAt != nil,
+	}
+}
+
+// SaveProgress writes the counters and checkpoint of a running job to its row, as long as the worker
+// still holds it
+func SaveProgress(db *gorm.DB, job *Job) error {
+	now := time.Now()
+	err := db.Model(&Job{}).
+		Where("id = ? AND worker_id = ? AND status = ?", job.ID, job.WorkerID, StatusProcessing).
+		Updates(map[string]interface{}{
+			"total_rows":     job.TotalRows,
+			"processed_rows": job.ProcessedRows,
+			"failed_rows":    job.FailedRows,
+			"inserted_rows":  job.InsertedRows,
+			"updated_rows":   job.UpdatedRows,
+			"skipped_rows":   job.SkippedRows,
+			"bytes_read":     job.BytesRead,
+			"total_bytes":    job.TotalBytes,
+			"checkpoint":     job.Checkpoint,
+			"updated_at":     now,
+		}).Error
+	if err != nil {
+		return err
+	}
+	job.UpdatedAt = now
+	return nil
+}
@@ -1,9 +1,17 @@
 package jobs
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
 	"gorm.io/gorm"
 )
 
@@ -13,8 +21,39 @@ const (
 	StatusProcessing = "PROCESSING"
 	StatusCompleted  = "COMPLETED"
 	StatusFailed     = "FAILED"
+	StatusCancelled  = "CANCELLED"
+	StatusDeadLetter = "DEAD_LETTER" // Retryable failure on the last allowed attempt
 )
 
+// ErrJobCancelled is the cancellation cause seen by a running job after POST /v1/jobs/:id/cancel
+var ErrJobCancelled = errors.New("job cancelled")
+
+// DefaultMaxAttempts is how many times a job may be picked up before it is given up on
+const DefaultMaxAttempts = 3
+
+// PermanentError marks a failure that retrying can't fix, such as a bad file format
+// or an unknown resource. Any other error is assumed to be transient.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the worker fails the job instead of retrying it
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsRetryable reports whether a failed job may be attempted again
+func IsRetryable(err error) bool {
+	var permanent *PermanentError
+	return !errors.As(err, &permanent)
+}
+
 // Job Type Constants
 const (
 	TypeImport = "IMPORT"
@@ -27,6 +66,10 @@ type Job struct {
 	Resource string    `gorm:"size:50;not null" json:"resource"`
 	Status   string    `gorm:"size:20;index;not null" json:"status"`
 
+	// Scheduling: higher priority is claimed first, nothing is claimed before RunAt
+	Priority int        `gorm:"default:0;index" json:"priority"`
+	RunAt    *time.Time `gorm:"index" json:"run_at,omitempty"`
+
 	// S3 Keys
 	SourceKey string `json:"-"` // File uploaded by user
 	ResultKey string `json:"-"` // Exported file OR Error Report
@@ -36,14 +79,310 @@ type Job struct {
 	ProcessedRows int `gorm:"default:0" json:"processed_rows"`
 	FailedRows    int `gorm:"default:0" json:"failed_rows"`
 
+	// Imports: what happened to the processed rows, and the rows deliberately left out.
+	// A dry run (Mode validate) counts what would have happened.
+	Mode         string `gorm:"size:20" json:"mode,omitempty"`
+	OnConflict   string `gorm:"size:10" json:"on_conflict,omitempty"`
+	InsertedRows int    `gorm:"default:0" json:"inserted_rows"`
+	UpdatedRows  int    `gorm:"default:0" json:"updated_rows"`
+	SkippedRows  int    `gorm:"default:0" json:"skipped_rows"`
+
+	// Imports: how far into the source file the worker is, out of its size (0 when unknown).
+	// TotalRows is extrapolated from both while the import runs.
+	BytesRead  int64 `gorm:"default:0" json:"bytes_read"`
+	TotalBytes int64 `gorm:"default:0" json:"total_bytes"`
+
+	// Imports: where a retried or re-queued import resumes from
+	Checkpoint *ImportCheckpoint `gorm:"type:text" json:"checkpoint,omitempty"`
+
+	// Exports: when the snapshot the rows were read from was taken, and the cursor of an
+	// incremental export picking up the changes made since
+	SnapshotAt *time.Time `json:"snapshot_at,omitempty"`
+	NextCursor string     `gorm:"type:text" json:"next_cursor,omitempty"`
+
 	// Reliability
 	IdempotencyKey string `gorm:"size:255;uniqueIndex" json:"-"`
 	ErrorMessage   string `gorm:"type:text" json:"error_message,omitempty"`
 
+	// Retries
+	Attempts    int        `gorm:"default:0" json:"attempts"`
+	MaxAttempts int        `gorm:"default:3" json:"max_attempts"`
+	NextRunAt   *time.Time `gorm:"index" json:"next_run_at,omitempty"` // Earliest time a retry may be claimed
+
+	// Lease (owner + heartbeat of the worker currently processing the job)
+	WorkerID    string     `gorm:"size:255;index" json:"worker_id,omitempty"`
+	HeartbeatAt *time.Time `gorm:"index" json:"heartbeat_at,omitempty"`
+
+	// Timings of the latest attempt
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // Set once the job reaches a final status
+
+	// Webhooks: CallbackURL is notified once the job is finished, along with the global subscriptions
+	CallbackURL      string     `gorm:"size:2048" json:"callback_url,omitempty"`
+	WebhooksQueuedAt *time.Time `gorm:"index" json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ImportCheckpoint is the point up to which an import is committed. Every record before Offset has
+// been imported or rejected, and the counters are the ones at that point.
+type ImportCheckpoint struct {
+	Format string   `json:"format"`           // csv, ndjson or json_array
+	Header []string `json:"header,omitempty"` // CSV header, needed to parse the rest of the file
+	Offset int64    `json:"offset"`           // Source byte offset right after the last committed record
+	Record int      `json:"record"`           // Records read up to Offset
+	Line   int      `json:"line,omitempty"`   // Lines read up to Offset, for the error report
+	Batch  int      `json:"batch"`            // Number of the last committed batch
+
+	ProcessedRows int `json:"processed_rows"`
+	FailedRows    int `json:"failed_rows"`
+	InsertedRows  int `json:"inserted_rows"`
+	UpdatedRows   int `json:"updated_rows"`
+	SkippedRows   int `json:"skipped_rows"`
+}
+
+// Value stores the checkpoint as JSON, also when it's written through a map of updates
+func (c ImportCheckpoint) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+func (c *ImportCheckpoint) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	}
+	return fmt.Errorf("unsupported checkpoint value: %T", value)
+}
+
+// ParseScheduling reads the optional priority and run_at (RFC3339) form values of a new job
+func ParseScheduling(priority, runAt string) (int, *time.Time, error) {
+	var p int
+	if priority != "" {
+		v, err := strconv.Atoi(priority)
+		if err != nil {
+			return 0, nil, fmt.Errorf("priority must be an integer")
+		}
+		p = v
+	}
+
+	if runAt == "" {
+		return p, nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, runAt)
+	if err != nil {
+		return 0, nil, fmt.Errorf("run_at must be an RFC3339 timestamp")
+	}
+	return p, &t, nil
+}
+
+// ExportConfig is the export configuration packed into the SourceKey of an export job
+type ExportConfig struct {
+	Format  string            `json:"format"`
+	Filter  string            `json:"filter,omitempty"`
+	Filters map[string]string `json:"filters"`
+	Expand  []string          `json:"expand,omitempty"`
+	Fields  []string          `json:"fields,omitempty"`
+	Since   *time.Time        `json:"since,omitempty"` // Incremental exports: rows changed at or after
+}
+
+// Import modes
+const (
+	ImportModeImport   = "import"
+	ImportModeValidate = "validate" // Dry run: parse, validate and look up dependencies without writing
+)
+
+// ValidateImportMode checks the mode of an import, defaulting an empty mode to import
+func ValidateImportMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ImportModeImport, nil
+	case ImportModeImport, ImportModeValidate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("mode must be import or validate")
+}
+
+// Conflict strategies, for import records whose key (user email, article slug, comment id) already exists
+const (
+	ConflictUpdate = "update" // Overwrite the existing row with every field the record supplies
+	ConflictSkip   = "skip"   // Keep the existing row, the record counts as skipped
+	ConflictFail   = "fail"   // Keep the existing row, the record is rejected in the error report
+)
+
+// ValidateConflictStrategy checks the on_conflict option of an import, defaulting to update
+func ValidateConflictStrategy(strategy string) (string, error) {
+	switch strategy {
+	case "":
+		return ConflictUpdate, nil
+	case ConflictUpdate, ConflictSkip, ConflictFail:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("on_conflict must be skip, update or fail")
+}
+
+// ConflictStrategy is the job's on_conflict option, update for jobs created before it existed
+func (j *Job) ConflictStrategy() string {
+	if j.OnConflict == "" {
+		return ConflictUpdate
+	}
+	return j.OnConflict
+}
+
+// DryRun reports whether the job only validates its file
+func (j *Job) DryRun() bool {
+	return j.Mode == ImportModeValidate
+}
+
+// ValidateExport checks the resource and format of an export, defaulting an empty format to ndjson
+func ValidateExport(resource, format string) (string, error) {
+	if resource != "users" && resource != "articles" && resource != "comments" {
+		return "", fmt.Errorf("Invalid resource")
+	}
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" && format != "json" {
+		return "", fmt.Errorf("Invalid format. Use: ndjson, csv, or json")
+	}
+	return format, nil
+}
+
+// Export expansions: related data embedded in each exported article
+const (
+	ExpandTags           = "tags"
+	ExpandAuthor         = "author"
+	ExpandComments       = "comments"
+	ExpandFavoritesCount = "favorites_count"
+)
+
+// ExpandOptions lists the expansions in the order their CSV columns come in
+var ExpandOptions = []string{ExpandTags, ExpandAuthor, ExpandComments, ExpandFavoritesCount}
+
+// ValidateExpand checks the expand option of an export. Each entry may hold several expansions
+// separated by commas; they come back deduplicated, in the order of ExpandOptions.
+func ValidateExpand(resource string, expand []string) ([]string, error) {
+	requested := make(map[string]bool)
+	for _, entry := range expand {
+		for _, name := range strings.Split(entry, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(ExpandOptions, name) {
+				return nil, fmt.Errorf("unknown expand %q, use: %s", name, strings.Join(ExpandOptions, ", "))
+			}
+			requested[name] = true
+		}
+	}
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	if resource != "articles" {
+		return nil, fmt.Errorf("expand is only supported for articles")
+	}
+
+	var valid []string
+	for _, name := range ExpandOptions {
+		if requested[name] {
+			valid = append(valid, name)
+		}
+	}
+	return valid, nil
+}
+
+// NewExportJob builds a PENDING export job. An empty idempotencyKey defaults to the job ID.
+func NewExportJob(resource string, config ExportConfig, idempotencyKey string) Job {
+	jobUUID := uuid.New()
+	if idempotencyKey == "" {
+		idempotencyKey = jobUUID.String()
+	}
+	configBytes, _ := json.Marshal(config)
+
+	return Job{
+		ID:             jobUUID,
+		Type:           TypeExport,
+		Resource:       resource,
+		Status:         StatusPending,
+		SourceKey:      string(configBytes),
+		IdempotencyKey: idempotencyKey,
+	}
+}
+
+// Schedule enqueues an export job every time its cron expression fires
+type Schedule struct {
+	ID       uuid.UUID         `gorm:"type:uuid;primary_key;" json:"id"`
+	Name     string            `gorm:"size:255" json:"name"`
+	Cron     string            `gorm:"size:100;not null" json:"cron"` // Standard 5-field expression, UTC unless prefixed with CRON_TZ=
+	Resource string            `gorm:"size:50;not null" json:"resource"`
+	Format   string            `gorm:"size:20;not null" json:"format"`
+	Filter   string            `gorm:"type:text" json:"filter,omitempty"`
+	Filters  map[string]string `gorm:"serializer:json" json:"filters"`
+	Expand   []string          `gorm:"serializer:json" json:"expand,omitempty"`
+	Fields   []string          `gorm:"serializer:json" json:"fields,omitempty"`
+	Priority int               `json:"priority"`
+	Enabled  bool              `gorm:"not null;index" json:"enabled"`
+
+	// Incremental firings only export the rows changed since the last job of the schedule that
+	// completed, from its next_cursor. Until one has, they export everything.
+	Incremental bool `gorm:"not null;default:false" json:"incremental"`
+
+	// Run tracking
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastJobID *uuid.UUID `gorm:"type:uuid" json:"last_job_id,omitempty"`
+	NextRunAt *time.Time `gorm:"index" json:"next_run_at,omitempty"` // Next firing, nil while disabled
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// ParseCron validates a standard 5-field cron expression (descriptors like @daily are accepted too)
+func ParseCron(expr string) (cron.Schedule, error) {
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression: %v", err)
+	}
+	return sched, nil
+}
+
+// NextRun returns the first firing of the schedule strictly after t
+func (s *Schedule) NextRun(after time.Time) (time.Time, error) {
+	sched, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(after.UTC()), nil
+}
+
+// ExportConfig is the configuration of the jobs the schedule queues, since is where an incremental
+// one starts from
+func (s *Schedule) ExportConfig(since *time.Time) ExportConfig {
+	return ExportConfig{
+		Format:  s.Format,
+		Filter:  s.Filter,
+		Filters: s.Filters,
+		Expand:  s.Expand,
+		Fields:  s.Fields,
+		Since:   since,
+	}
+}
+
+// JobKeyPrefix starts the idempotency key of every job the schedule queues
+func (s *Schedule) JobKeyPrefix() string {
+	return "schedule:" + s.ID.String() + ":"
+}
+
+// BeforeCreate is a GORM hook to generate UUIDs
+func (s *Schedule) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return
+}
+
 // BeforeCreate is a GORM hook to generate UUIDs
 func (j *Job) BeforeCreate(tx *gorm.DB) (err error) {
 	if j.ID == uuid.Nil {
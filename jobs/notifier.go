@@ -0,0 +1,146 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// NotifyChannel is the Postgres channel new jobs are announced on
+const NotifyChannel = "jobs_created"
+
+// Notifier wakes up workers as soon as a job is queued, so they don't have to poll for it
+type Notifier interface {
+	// Notify announces a new job of the given type
+	Notify(ctx context.Context, jobType string) error
+	// Listen delivers the type of every announced job until ctx is done
+	Listen(ctx context.Context) (<-chan string, error)
+}
+
+var notifier Notifier = NewMemoryNotifier()
+
+// SetNotifier replaces the process-wide notifier (in-memory by default)
+func SetNotifier(n Notifier) {
+	notifier = n
+}
+
+func GetNotifier() Notifier {
+	return notifier
+}
+
+// NotifyQueued announces a freshly created job. Failures are only logged:
+// the workers' fallback sweep picks the job up anyway.
+func NotifyQueued(ctx context.Context, job Job) {
+	if err := GetNotifier().Notify(ctx, job.Type); err != nil {
+		log.Printf("[Jobs] Could not notify workers about Job %s: %v", job.ID, err)
+	}
+}
+
+// MemoryNotifier delivers notifications within a single process.
+// It is used in tests and when the API and workers share one instance.
+type MemoryNotifier struct {
+	mu        sync.Mutex
+	listeners map[chan string]struct{}
+}
+
+func NewMemoryNotifier() *MemoryNotifier {
+	return &MemoryNotifier{listeners: make(map[chan string]struct{})}
+}
+
+func (n *MemoryNotifier) Notify(ctx context.Context, jobType string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.listeners {
+		// Never block the caller: a listener that is behind will still sweep the queue
+		select {
+		case ch <- jobType:
+		default:
+		}
+	}
+	return nil
+}
+
+func (n *MemoryNotifier) Listen(ctx context.Context) (<-chan string, error) {
+	ch := make(chan string, 16)
+	n.mu.Lock()
+	n.listeners[ch] = struct{}{}
+	n.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		n.mu.Lock()
+		delete(n.listeners, ch)
+		close(ch)
+		n.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+// PostgresNotifier uses LISTEN/NOTIFY, so a job created on one instance wakes workers on all of them
+type PostgresNotifier struct {
+	db  *gorm.DB
+	dsn string
+}
+
+// NewPostgresNotifier sends notifications through db and listens on a dedicated connection to dsn
+func NewPostgresNotifier(db *gorm.DB, dsn string) *PostgresNotifier {
+	return &PostgresNotifier{db: db, dsn: dsn}
+}
+
+func (n *PostgresNotifier) Notify(ctx context.Context, jobType string) error {
+	return n.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", NotifyChannel, jobType).Error
+}
+
+func (n *PostgresNotifier) Listen(ctx context.Context) (<-chan string, error) {
+	conn, err := n.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan string, 16)
+	go func() {
+		defer close(ch)
+		for {
+			notification, err := conn.WaitForNotification(ctx)
+			if err == nil {
+				select {
+				case ch <- notification.Payload:
+				default:
+				}
+				continue
+			}
+
+			conn.Close(context.Background())
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Connection dropped: reconnect, the fallback sweep covers anything missed meanwhile
+			log.Printf("[Jobs] LISTEN connection lost: %v", err)
+			for conn, err = n.connect(ctx); err != nil; conn, err = n.connect(ctx) {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(2 * time.Second):
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (n *PostgresNotifier) connect(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, n.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+NotifyChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
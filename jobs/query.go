@@ -0,0 +1,204 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Page size of GET /v1/jobs
+const (
+	DefaultJobsLimit = 20
+	MaxJobsLimit     = 100
+)
+
+// jobSortColumns are the columns GET /v1/jobs can be sorted on
+var jobSortColumns = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+	"priority":   true,
+}
+
+// JobFilter selects one page of jobs
+type JobFilter struct {
+	Type          string
+	Resource      string
+	Statuses      []string
+	Owner         string // Worker ID holding (or that last held) the lease
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+
+	// Sort is a column name, prefixed with "-" for descending order
+	Sort   string
+	Limit  int
+	Cursor *JobCursor
+}
+
+// JobCursor points at the last job of the previous page. It only makes sense for the sort it was
+// issued with, so the sort is carried along and checked.
+type JobCursor struct {
+	Sort  string    `json:"s"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// Encode turns the cursor into the opaque string handed to clients
+func (c JobCursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeJobCursor(s string) (*JobCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor JobCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// ParseJobFilter reads the query string of GET /v1/jobs
+func ParseJobFilter(query url.Values) (JobFilter, error) {
+	filter := JobFilter{
+		Type:     strings.ToUpper(query.Get("type")),
+		Resource: query.Get("resource"),
+		Owner:    query.Get("owner"),
+		Sort:     query.Get("sort"),
+		Limit:    DefaultJobsLimit,
+	}
+
+	if filter.Type != "" && filter.Type != TypeImport && filter.Type != TypeExport {
+		return filter, fmt.Errorf("type must be IMPORT or EXPORT")
+	}
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			filter.Statuses = append(filter.Statuses, strings.ToUpper(strings.TrimSpace(s)))
+		}
+	}
+
+	for key, target := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		if v := query.Get(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC3339 timestamp", key)
+			}
+			*target = &t
+		}
+	}
+
+	if filter.Sort == "" {
+		filter.Sort = "-created_at"
+	}
+	if !jobSortColumns[strings.TrimPrefix(filter.Sort, "-")] {
+		return filter, fmt.Errorf("sort must be one of created_at, updated_at, priority (prefix with - for descending)")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v < 1 || v > MaxJobsLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", MaxJobsLimit)
+		}
+		filter.Limit = v
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		c, err := decodeJobCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+		if c.Sort != filter.Sort {
+			return filter, fmt.Errorf("cursor was issued for sort=%s", c.Sort)
+		}
+		if _, err := cursorValue(strings.TrimPrefix(c.Sort, "-"), c.Value); err != nil {
+			return filter, fmt.Errorf("invalid cursor")
+		}
+		filter.Cursor = c
+	}
+	return filter, nil
+}
+
+// FindJobs returns one page of jobs matching the filter, plus the cursor of the next page
+// (empty on the last page). Pages are keyset-based on the sort column and the job ID, so jobs
+// created while paging neither shift nor repeat the results.
+func FindJobs(db *gorm.DB, filter JobFilter) ([]Job, string, error) {
+	tx := db.Model(&Job{})
+	if filter.Type != "" {
+		tx = tx.Where("type = ?", filter.Type)
+	}
+	if filter.Resource != "" {
+		tx = tx.Where("resource = ?", filter.Resource)
+	}
+	if len(filter.Statuses) > 0 {
+		tx = tx.Where("status IN ?", filter.Statuses)
+	}
+	if filter.Owner != "" {
+		tx = tx.Where("worker_id = ?", filter.Owner)
+	}
+	if filter.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *filter.CreatedBefore)
+	}
+
+	column := strings.TrimPrefix(filter.Sort, "-")
+	direction, op := "ASC", ">"
+	if strings.HasPrefix(filter.Sort, "-") {
+		direction, op = "DESC", "<"
+	}
+
+	if filter.Cursor != nil {
+		value, err := cursorValue(column, filter.Cursor.Value)
+		if err != nil {
+			return nil, "", err
+		}
+		tx = tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, op, column, op),
+			value, value, filter.Cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	var jobs []Job
+	err := tx.Order(column + " " + direction).Order("id " + direction).
+		Limit(filter.Limit + 1).
+		Find(&jobs).Error
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(jobs) <= filter.Limit {
+		return jobs, "", nil
+	}
+	jobs = jobs[:filter.Limit]
+	last := jobs[len(jobs)-1]
+	next := JobCursor{Sort: filter.Sort, ID: last.ID}
+	switch column {
+	case "created_at":
+		next.Value = last.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "updated_at":
+		next.Value = last.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	case "priority":
+		next.Value = strconv.Itoa(last.Priority)
+	}
+	return jobs, next.Encode(), nil
+}
+
+// cursorValue converts the cursor's sort value back to the column's type
+func cursorValue(column, value string) (interface{}, error) {
+	if column == "priority" {
+		return strconv.Atoi(value)
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
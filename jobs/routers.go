@@ -12,14 +12,23 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"gorm.io/gorm"
 )
 
 func JobsRegister(router *gin.RouterGroup) {
 	router.POST("/imports", CreateImportJob)
-	router.GET("/imports/:id", GetJobStatus)
 	router.GET("/imports/:id/errors", GetJobErrors)
+	router.GET("/jobs", ListJobs)
+	router.GET("/jobs/:id", GetJobStatus)
+	router.GET("/jobs/:id/events", StreamJobEvents)
+	router.POST("/jobs/:id/cancel", CancelJob)
+	router.GET("/jobs/:id/webhooks", ListJobDeliveries)
+
+	// Older per-type status paths, kept as aliases of /jobs/:id
+	router.GET("/imports/:id", GetJobStatus)
+	router.GET("/exports/:id", GetJobStatus)
 }
 
 // CreateImportJob handles POST /v1/imports
@@ -50,6 +59,31 @@ func CreateImportJob(c *gin.Context) {
 		return
 	}
 
+	priority, runAt, err := ParseScheduling(c.PostForm("priority"), c.PostForm("run_at"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	callbackURL := c.PostForm("callback_url")
+	if callbackURL != "" {
+		if err := ValidateCallbackURL(callbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	mode, err := ValidateImportMode(c.PostForm("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	onConflict, err := ValidateConflictStrategy(c.PostForm("on_conflict"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Open File Stream
 	file, err := fileHeader.Open()
 	if err != nil {
@@ -79,26 +113,40 @@ func CreateImportJob(c *gin.Context) {
 		Type:           TypeImport,
 		Resource:       resource,
 		Status:         StatusPending,
+		Priority:       priority,
+		RunAt:          runAt,
 		SourceKey:      key,
 		IdempotencyKey: idempotencyKey,
+		CallbackURL:    callbackURL,
+		Mode:           mode,
+		OnConflict:     onConflict,
 	}
 
 	if err := db.Create(&job).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create job record"})
 		return
 	}
+	NotifyQueued(c.Request.Context(), job)
 
 	// Return 202 Accepted
 	c.JSON(http.StatusAccepted, gin.H{
-		"message": "Import job accepted",
-		"job_id":  job.ID,
-		"status":  job.Status,
+		"message":     "Import job accepted",
+		"job_id":      job.ID,
+		"mode":        job.Mode,
+		"on_conflict": job.OnConflict,
+		"status":      job.Status,
+		"priority":    job.Priority,
+		"run_at":      job.RunAt,
 	})
 }
 
-// GetJobStatus handles GET /v1/imports/:id
+// GetJobStatus handles GET /v1/jobs/:id (and its aliases GET /v1/imports/:id, GET /v1/exports/:id)
 func GetJobStatus(c *gin.Context) {
-	id := c.Param("id")
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
 	db := common.GetDB()
 	var job Job
 
@@ -111,7 +159,197 @@ func GetJobStatus(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, job)
+	serializer := JobSerializer{C: c, Job: job}
+	c.JSON(http.StatusOK, serializer.Response())
+}
+
+// StreamJobEvents handles GET /v1/jobs/:id/events
+// It streams Server-Sent Events: "status" on every status transition, "progress" when the counters
+// move, and a final "summary" (the full job status) once the job is finished, then closes the stream.
+// Updates come from the workers of this instance as they flush batches; a slow DB poll covers the rest.
+func StreamJobEvents(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	db := common.GetDB()
+
+	// Subscribe before reading the row, so no update can slip in between
+	updates, unsubscribe := GetEventBroker().Subscribe(id)
+	defer unsubscribe()
+
+	var job Job
+	if err := db.First(&job, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Don't let a proxy buffer the stream
+
+	sendProgress := func(update JobUpdate) {
+		c.SSEvent("progress", gin.H{
+			"job_id":         update.ID,
+			"status":         update.Status,
+			"total_rows":     update.TotalRows,
+			"processed_rows": update.ProcessedRows,
+			"failed_rows":    update.FailedRows,
+			"skipped_rows":   update.SkippedRows,
+			"progress":       progressPercent(update.Status, update.TotalRows, update.ProcessedRows, update.FailedRows+update.SkippedRows),
+		})
+	}
+	sendSummary := func() {
+		// The final row holds the timings and download links
+		var final Job
+		if err := db.First(&final, "id = ?", id).Error; err == nil {
+			job = final
+		}
+		serializer := JobSerializer{C: c, Job: job}
+		c.SSEvent("summary", serializer.Response())
+	}
+
+	// Start with the current state
+	last := job.Update()
+	c.SSEvent("status", gin.H{"job_id": job.ID, "status": job.Status})
+	sendProgress(last)
+	if last.Finished {
+		sendSummary()
+		return
+	}
+	c.Writer.Flush()
+
+	// emit sends what changed since the last update, and reports whether the stream is over
+	emit := func(update JobUpdate) bool {
+		if update.Status == last.Status && update.ProcessedRows+update.FailedRows+update.SkippedRows < last.ProcessedRows+last.FailedRows+last.SkippedRows {
+			// A DB poll can lag behind the updates published by a worker in this process
+			update.TotalRows, update.ProcessedRows, update.FailedRows, update.SkippedRows = last.TotalRows, last.ProcessedRows, last.FailedRows, last.SkippedRows
+		}
+		if update.Status != last.Status {
+			c.SSEvent("status", gin.H{"job_id": update.ID, "status": update.Status, "previous_status": last.Status})
+		}
+		if update.ProcessedRows != last.ProcessedRows || update.FailedRows != last.FailedRows ||
+			update.SkippedRows != last.SkippedRows || update.TotalRows != last.TotalRows {
+			sendProgress(update)
+		}
+		last = update
+
+		if update.Finished {
+			sendSummary()
+		}
+		c.Writer.Flush()
+		return update.Finished
+	}
+
+	ticker := time.NewTicker(EventPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case update := <-updates:
+			if emit(update) {
+				return
+			}
+		case <-ticker.C:
+			var current Job
+			if err := db.First(&current, "id = ?", id).Error; err != nil {
+				continue
+			}
+			if emit(current.Update()) {
+				return
+			}
+		}
+	}
+}
+
+// CancelJob handles POST /v1/jobs/:id/cancel
+// A PENDING job is cancelled straight away. A PROCESSING job is flagged as CANCELLED and its
+// worker stops at the next batch boundary, keeping the rows it already committed.
+func CancelJob(c *gin.Context) {
+	id := c.Param("id")
+	db := common.GetDB()
+
+	result := db.Model(&Job{}).
+		Where("id = ? AND status IN ?", id, []string{StatusPending, StatusProcessing}).
+		Updates(map[string]interface{}{
+			"status": StatusCancelled,
+			// A queued job is finished right away, a running one once its worker stops
+			"finished_at": gorm.Expr("CASE WHEN status = ? THEN ? ELSE NULL END", StatusPending, time.Now()),
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var job Job
+	if err := db.First(&job, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job can no longer be cancelled", "job_id": job.ID, "status": job.Status})
+		return
+	}
+	PublishProgress(&job)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Job cancellation requested",
+		"job_id":  job.ID,
+		"status":  job.Status,
+	})
+}
+
+// ListJobs handles GET /v1/jobs
+// Filters: type, resource, status (comma separated), owner, created_after, created_before.
+// Paging: sort, limit and the cursor returned as next_cursor by the previous page.
+func ListJobs(c *gin.Context) {
+	filter, err := ParseJobFilter(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobs, nextCursor, err := FindJobs(common.GetDB(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+		return
+	}
+
+	serializer := JobsSerializer{C: c, Jobs: jobs}
+	c.JSON(http.StatusOK, gin.H{"jobs": serializer.Response(), "count": len(jobs), "next_cursor": nextCursor})
+}
+
+// ListJobDeliveries handles GET /v1/jobs/:id/webhooks
+// It returns the delivery log of the webhooks sent for the job, oldest first.
+func ListJobDeliveries(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	db := common.GetDB()
+
+	var job Job
+	if err := db.Select("id").First(&job, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	var deliveries []WebhookDelivery
+	if err := db.Where("job_id = ?", id).Order("created_at ASC").Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "count": len(deliveries)})
 }
 
 // GetJobErrors handles GET /v1/imports/:id/errors
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+type JobSerializer struct {
+	C *gin.Context
+	Job
+}
+
+type JobResponse struct {
+	JobID         uuid.UUID  `json:"job_id"`
+	Type          string     `json:"type"`
+	Resource      string     `json:"resource"`
+	Status        string     `json:"status"`
+	Priority      int        `json:"priority"`
+	TotalRows     int        `json:"total_rows"`
+	ProcessedRows int        `json:"processed_rows"`
+	FailedRows    int        `json:"failed_rows"`
+	Progress      *float64   `json:"progress"`              // Percentage, null while the total is unknown
+	EtaSeconds    *float64   `json:"eta_seconds,omitempty"` // Estimated time left, while the job runs
+	BytesRead     int64      `json:"bytes_read,omitempty"`  // Imports: position in the source file
+	TotalBytes    int64      `json:"total_bytes,omitempty"` // Imports: size of the source file
+	Attempts      int        `json:"attempts"`
+	MaxAttempts   int        `json:"max_attempts"`
+	WorkerID      string     `json:"worker_id"`
+	ErrorMessage  string     `json:"error_message,omitempty"` // Failed, dead-lettered and retrying jobs carry the last error
+	RunAt         *time.Time `json:"run_at,omitempty"`
+	NextRunAt     *time.Time `json:"next_run_at,omitempty"`
+
+	// Timings of the latest attempt; the duration keeps growing while the job runs
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds *float64   `json:"duration_seconds,omitempty"`
+
+	// Imports: what happened to the rows, or for a dry run what would have happened
+	Mode       string         `json:"mode,omitempty"`
+	OnConflict string         `json:"on_conflict,omitempty"`
+	Stats      *ImportStats   `json:"stats,omitempty"`
+	DryRun     *DryRunSummary `json:"dry_run,omitempty"`
+
+	DownloadURL    string     `json:"download_url,omitempty"`     // Exported file
+	SnapshotAt     *time.Time `json:"snapshot_at,omitempty"`      // Exports: the data is as it was then
+	NextCursor     string     `json:"next_cursor,omitempty"`      // Exports: where an incremental export of the changes since starts
+	ErrorReportURL string     `json:"error_report_url,omitempty"` // Rows an import rejected
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ImportStats struct {
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Skipped  int `json:"skipped"`
+}
+
+type DryRunSummary struct {
+	WouldInsert int `json:"would_insert"`
+	WouldUpdate int `json:"would_update"`
+	WouldSkip   int `json:"would_skip"`
+	WouldFail   int `json:"would_fail"`
+}
+
+type JobsSerializer struct {
+	C    *gin.Context
+	Jobs []Job
+}
+
+func (s *JobSerializer) Response() JobResponse {
+	response := JobResponse{
+		JobID:         s.ID,
+		Type:          s.Type,
+		Resource:      s.Resource,
+		Status:        s.Status,
+		Priority:      s.Priority,
+		TotalRows:     s.TotalRows,
+		ProcessedRows: s.ProcessedRows,
+		FailedRows:    s.FailedRows,
+		BytesRead:     s.BytesRead,
+		TotalBytes:    s.TotalBytes,
+		Attempts:      s.Attempts,
+		MaxAttempts:   s.MaxAttempts,
+		WorkerID:      s.WorkerID,
+		ErrorMessage:  s.ErrorMessage,
+		RunAt:         s.RunAt,
+		NextRunAt:     s.NextRunAt,
+		StartedAt:     s.StartedAt,
+		FinishedAt:    s.FinishedAt,
+		SnapshotAt:    s.SnapshotAt,
+		CreatedAt:     s.CreatedAt,
+		UpdatedAt:     s.UpdatedAt,
+	}
+
+	response.Progress = progressPercent(s.Status, s.TotalRows, s.ProcessedRows, s.FailedRows+s.SkippedRows)
+
+	// Remaining time assuming the rest goes as fast as what was done so far
+	if s.Status == StatusProcessing && s.StartedAt != nil && response.Progress != nil &&
+		*response.Progress > 0 && *response.Progress < 100 {
+		done := *response.Progress
+		eta := math.Round(time.Since(*s.StartedAt).Seconds() * (100 - done) / done)
+		response.EtaSeconds = &eta
+	}
+
+	if s.StartedAt != nil {
+		end := time.Now()
+		if s.FinishedAt != nil {
+			end = *s.FinishedAt
+		}
+		duration := math.Round(end.Sub(*s.StartedAt).Seconds()*1000) / 1000
+		response.DurationSeconds = &duration
+	}
+
+	if s.Type == TypeImport {
+		response.Mode = s.Mode
+		response.OnConflict = s.OnConflict
+		if s.DryRun() {
+			response.DryRun = &DryRunSummary{
+				WouldInsert: s.InsertedRows,
+				WouldUpdate: s.UpdatedRows,
+				WouldSkip:   s.SkippedRows,
+				WouldFail:   s.FailedRows,
+			}
+		} else {
+			response.Stats = &ImportStats{Inserted: s.InsertedRows, Updated: s.UpdatedRows, Skipped: s.SkippedRows}
+		}
+	}
+
+	// The result file is the exported data for exports and the error report for imports
+	if s.ResultKey != "" {
+		switch {
+		case s.Type == TypeExport && s.Status == StatusCompleted:
+			if url, err := common.GetPresignedURL(s.ResultKey); err == nil {
+				response.DownloadURL = url
+			}
+			response.NextCursor = s.NextCursor
+		case s.Type == TypeImport && s.FailedRows > 0:
+			if url, err := common.GetPresignedURL(s.ResultKey); err == nil {
+				response.ErrorReportURL = url
+			}
+		}
+	}
+	return response
+}
+
+// progressPercent is the share of the rows done, or nil while the total is unknown.
+// failed covers every row that was read but not written.
+func progressPercent(status string, total, processed, failed int) *float64 {
+	if status == StatusCompleted {
+		progress := 100.0
+		return &progress
+	}
+	if total <= 0 {
+		return nil
+	}
+	done := float64(processed+failed) / float64(total) * 100
+	progress := math.Min(100, math.Round(done*10)/10)
+	return &progress
+}
+
+func (s *JobsSerializer) Response() []JobResponse {
+	response := []JobResponse{}
+	for _, job := range s.Jobs {
+		serializer := JobSerializer{C: s.C, Job: job}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
@@ -0,0 +1,836 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	return testutil.SetupDB(t, &Job{}, &WebhookSubscription{}, &WebhookDelivery{})
+}
+
+func setupTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	JobsRegister(r.Group("/v1"))
+	return r
+}
+
+func createJob(t *testing.T, db *gorm.DB, jobType, status string) Job {
+	job := Job{
+		Type:           jobType,
+		Resource:       "users",
+		Status:         status,
+		IdempotencyKey: uuid.NewString(),
+	}
+	require.NoError(t, db.Create(&job).Error)
+	return job
+}
+
+func TestCancelJob(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter()
+
+	tests := []struct {
+		name       string
+		status     string
+		wantCode   int
+		wantStatus string
+	}{
+		{"pending job is cancelled", StatusPending, http.StatusAccepted, StatusCancelled},
+		{"running job is flagged for its worker", StatusProcessing, http.StatusAccepted, StatusCancelled},
+		{"finished job is left alone", StatusCompleted, http.StatusConflict, StatusCompleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := createJob(t, db, TypeImport, tt.status)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/jobs/"+job.ID.String()+"/cancel", nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantStatus, body["status"])
+
+			var stored Job
+			require.NoError(t, db.First(&stored, "id = ?", job.ID).Error)
+			assert.Equal(t, tt.wantStatus, stored.Status)
+		})
+	}
+
+	t.Run("unknown job", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/jobs/"+uuid.NewString()+"/cancel", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestMemoryNotifier(t *testing.T) {
+	notifier := NewMemoryNotifier()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := notifier.Listen(ctx)
+	require.NoError(t, err)
+	second, err := notifier.Listen(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, notifier.Notify(context.Background(), TypeImport))
+
+	for _, ch := range []<-chan string{first, second} {
+		select {
+		case jobType := <-ch:
+			assert.Equal(t, TypeImport, jobType)
+		case <-time.After(time.Second):
+			t.Fatal("listener was not notified")
+		}
+	}
+
+	// Listeners are closed once their context is done
+	cancel()
+	select {
+	case _, open := <-first:
+		assert.False(t, open)
+	case <-time.After(time.Second):
+		t.Fatal("listener was not closed")
+	}
+}
+
+func TestParseScheduling(t *testing.T) {
+	priority, runAt, err := ParseScheduling("", "")
+	require.NoError(t, err)
+	assert.Zero(t, priority)
+	assert.Nil(t, runAt)
+
+	priority, runAt, err = ParseScheduling("5", "2026-02-05T02:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, 5, priority)
+	require.NotNil(t, runAt)
+	assert.Equal(t, time.Date(2026, 2, 5, 2, 0, 0, 0, time.UTC), runAt.UTC())
+
+	_, _, err = ParseScheduling("high", "")
+	assert.Error(t, err)
+
+	_, _, err = ParseScheduling("", "tonight")
+	assert.Error(t, err)
+}
+
+func TestCreateImportJob_RejectsBadRunAt(t *testing.T) {
+	setupTestDB(t)
+	router := setupTestRouter()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("resource", "users")
+	form.WriteField("run_at", "tonight")
+	part, _ := form.CreateFormFile("file", "users.csv")
+	part.Write([]byte("id,email,name\n"))
+	form.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/imports", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "run_at")
+}
+
+func TestScheduleNextRun(t *testing.T) {
+	schedule := Schedule{Cron: "30 2 * * 1-5"}
+
+	// Friday 03:00 -> Monday 02:30
+	next, err := schedule.NextRun(time.Date(2026, 3, 6, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 9, 2, 30, 0, 0, time.UTC), next)
+
+	schedule.Cron = "every night"
+	_, err = schedule.NextRun(time.Now())
+	assert.Error(t, err)
+}
+
+func TestValidateExport(t *testing.T) {
+	format, err := ValidateExport("articles", "")
+	require.NoError(t, err)
+	assert.Equal(t, "ndjson", format)
+
+	_, err = ValidateExport("tags", "csv")
+	assert.Error(t, err)
+
+	_, err = ValidateExport("users", "xml")
+	assert.Error(t, err)
+}
+
+func TestValidateExpand(t *testing.T) {
+	expand, err := ValidateExpand("articles", []string{"favorites_count, Tags", "author", "tags"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{ExpandTags, ExpandAuthor, ExpandFavoritesCount}, expand)
+
+	expand, err = ValidateExpand("users", []string{""})
+	require.NoError(t, err)
+	assert.Empty(t, expand)
+
+	_, err = ValidateExpand("articles", []string{"tags,likes"})
+	assert.EqualError(t, err, `unknown expand "likes", use: tags, author, comments, favorites_count`)
+
+	_, err = ValidateExpand("comments", []string{"author"})
+	assert.EqualError(t, err, "expand is only supported for articles")
+}
+
+type listJobsResponse struct {
+	Jobs       []JobResponse `json:"jobs"`
+	Count      int           `json:"count"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+func listJobs(t *testing.T, router *gin.Engine, query string) (int, listJobsResponse) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/jobs?"+query, nil)
+	router.ServeHTTP(w, req)
+
+	var body listJobsResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w.Code, body
+}
+
+func TestListJobs_Filters(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter()
+
+	failedImport := createJob(t, db, TypeImport, StatusFailed)
+	createJob(t, db, TypeImport, StatusCompleted)
+	runningExport := createJob(t, db, TypeExport, StatusProcessing)
+	db.Model(&runningExport).Updates(map[string]interface{}{"resource": "articles", "worker_id": "host-1-EXPORT-0"})
+
+	_, body := listJobs(t, router, "type=import&status=FAILED,DEAD_LETTER")
+	require.Len(t, body.Jobs, 1)
+	assert.Equal(t, failedImport.ID, body.Jobs[0].JobID)
+
+	_, body = listJobs(t, router, "resource=articles")
+	require.Len(t, body.Jobs, 1)
+	assert.Equal(t, runningExport.ID, body.Jobs[0].JobID)
+
+	_, body = listJobs(t, router, "owner=host-1-EXPORT-0")
+	require.Len(t, body.Jobs, 1)
+	assert.Equal(t, "host-1-EXPORT-0", body.Jobs[0].WorkerID)
+
+	old := createJob(t, db, TypeExport, StatusCompleted)
+	db.Model(&old).Update("created_at", time.Now().Add(-48*time.Hour))
+	_, body = listJobs(t, router, "created_before="+time.Now().Add(-24*time.Hour).UTC().Format(time.RFC3339))
+	require.Len(t, body.Jobs, 1)
+	assert.Equal(t, old.ID, body.Jobs[0].JobID)
+
+	_, body = listJobs(t, router, "created_after="+time.Now().Add(-24*time.Hour).UTC().Format(time.RFC3339))
+	assert.Equal(t, 3, body.Count)
+}
+
+func TestListJobs_CursorPagination(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter()
+
+	created := map[uuid.UUID]bool{}
+	for i := 0; i < 5; i++ {
+		job := createJob(t, db, TypeExport, StatusPending)
+		db.Model(&job).Update("priority", i%2)
+		created[job.ID] = true
+	}
+
+	for _, sort := range []string{"", "created_at", "-priority", "updated_at"} {
+		seen := map[uuid.UUID]bool{}
+		cursor := ""
+		pages := 0
+		for {
+			code, body := listJobs(t, router, "limit=2&sort="+sort+"&cursor="+cursor)
+			require.Equal(t, http.StatusOK, code)
+			for _, job := range body.Jobs {
+				assert.False(t, seen[job.JobID], "job %s listed twice with sort=%q", job.JobID, sort)
+				seen[job.JobID] = true
+			}
+			pages++
+			if body.NextCursor == "" {
+				break
+			}
+			cursor = body.NextCursor
+		}
+		assert.Equal(t, created, seen, "sort=%q", sort)
+		assert.Equal(t, 3, pages, "sort=%q", sort)
+	}
+
+	_, body := listJobs(t, router, "sort=-priority")
+	require.Len(t, body.Jobs, 5)
+	assert.Equal(t, 1, body.Jobs[0].Priority)
+	assert.Equal(t, 0, body.Jobs[4].Priority)
+}
+
+func TestListJobs_RejectsBadQuery(t *testing.T) {
+	setupTestDB(t)
+	router := setupTestRouter()
+
+	cursor := JobCursor{Sort: "-created_at", Value: time.Now().UTC().Format(time.RFC3339Nano), ID: uuid.New()}.Encode()
+	// Well-formed cursors carrying a value that doesn't fit their sort column
+	badPriority := JobCursor{Sort: "priority", Value: "high", ID: uuid.New()}.Encode()
+	badTimestamp := JobCursor{Sort: "-created_at", Value: "yesterday", ID: uuid.New()}.Encode()
+
+	for _, query := range []string{
+		"type=backfill",
+		"created_after=yesterday",
+		"sort=status",
+		"limit=0",
+		"limit=1000",
+		"cursor=not-a-cursor",
+		"sort=priority&cursor=" + cursor,
+		"sort=priority&cursor=" + badPriority,
+		"cursor=" + badTimestamp,
+	} {
+		code, _ := listJobs(t, router, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+// setupTestPresigner lets the status handlers sign download links without a running S3
+func setupTestPresigner(t *testing.T) {
+	t.Setenv("S3_BUCKET", "test-bucket")
+	original := common.PresignClient
+	common.PresignClient = s3.NewPresignClient(s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}))
+	t.Cleanup(func() { common.PresignClient = original })
+}
+
+func getJobStatus(t *testing.T, router *gin.Engine, path string) (int, JobResponse) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	router.ServeHTTP(w, req)
+
+	var body JobResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w.Code, body
+}
+
+func TestGetJobStatus_Export(t *testing.T) {
+	db := setupTestDB(t)
+	setupTestPresigner(t)
+	router := setupTestRouter()
+
+	job := createJob(t, db, TypeExport, StatusProcessing)
+	started := time.Now().Add(-10 * time.Second)
+	db.Model(&job).Updates(map[string]interface{}{
+		"resource": "articles", "total_rows": 200, "processed_rows": 50,
+		"result_key": "exports/articles/articles-1.ndjson", "started_at": started,
+	})
+
+	// The old export path used to 404 on every job
+	for _, path := range []string{"/v1/jobs/", "/v1/exports/"} {
+		code, body := getJobStatus(t, router, path+job.ID.String())
+		require.Equal(t, http.StatusOK, code, path)
+		assert.Equal(t, job.ID, body.JobID)
+		assert.Equal(t, TypeExport, body.Type)
+		require.NotNil(t, body.Progress)
+		assert.Equal(t, 25.0, *body.Progress)
+		require.NotNil(t, body.DurationSeconds)
+		assert.InDelta(t, 10, *body.DurationSeconds, 2)
+		assert.Empty(t, body.DownloadURL, "no download until the export completes")
+	}
+
+	finished := started.Add(30 * time.Second)
+	db.Model(&job).Updates(map[string]interface{}{"status": StatusCompleted, "processed_rows": 200, "finished_at": finished})
+
+	_, body := getJobStatus(t, router, "/v1/jobs/"+job.ID.String())
+	assert.Equal(t, 100.0, *body.Progress)
+	assert.Equal(t, 30.0, *body.DurationSeconds)
+	assert.Contains(t, body.DownloadURL, "exports/articles/articles-1.ndjson")
+	assert.Empty(t, body.ErrorReportURL)
+}
+
+func TestGetJobStatus_Import(t *testing.T) {
+	db := setupTestDB(t)
+	setupTestPresigner(t)
+	router := setupTestRouter()
+
+	job := createJob(t, db, TypeImport, StatusCompleted)
+	db.Model(&job).Updates(map[string]interface{}{
+		"total_rows": 100, "processed_rows": 95, "failed_rows": 5,
+		"result_key": "imports/errors/users-1.csv",
+	})
+
+	for _, path := range []string{"/v1/jobs/", "/v1/imports/"} {
+		code, body := getJobStatus(t, router, path+job.ID.String())
+		require.Equal(t, http.StatusOK, code, path)
+		assert.Equal(t, TypeImport, body.Type)
+		assert.Equal(t, 95, body.ProcessedRows)
+		assert.Equal(t, 5, body.FailedRows)
+		assert.Equal(t, 100.0, *body.Progress)
+		assert.Contains(t, body.ErrorReportURL, "imports/errors/users-1.csv")
+		assert.Empty(t, body.DownloadURL)
+		assert.NotNil(t, body.Stats)
+		assert.Nil(t, body.DryRun)
+	}
+
+	// A dry run reports what would have happened instead
+	dryRun := createJob(t, db, TypeImport, StatusCompleted)
+	db.Model(&dryRun).Updates(map[string]interface{}{
+		"mode": ImportModeValidate, "processed_rows": 10, "inserted_rows": 7, "updated_rows": 3, "skipped_rows": 2, "failed_rows": 1,
+	})
+	_, body := getJobStatus(t, router, "/v1/jobs/"+dryRun.ID.String())
+	assert.Equal(t, ImportModeValidate, body.Mode)
+	assert.Nil(t, body.Stats)
+	require.NotNil(t, body.DryRun)
+	assert.Equal(t, DryRunSummary{WouldInsert: 7, WouldUpdate: 3, WouldSkip: 2, WouldFail: 1}, *body.DryRun)
+
+	// A queued job has no known total yet
+	pending := createJob(t, db, TypeImport, StatusPending)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/jobs/"+pending.ID.String(), nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"progress":null`)
+}
+
+func TestGetJobStatus_NotFound(t *testing.T) {
+	setupTestDB(t)
+	router := setupTestRouter()
+
+	for _, path := range []string{"/v1/jobs/" + uuid.NewString(), "/v1/exports/not-a-uuid"} {
+		code, _ := getJobStatus(t, router, path)
+		assert.Equal(t, http.StatusNotFound, code, path)
+	}
+}
+
+type sseEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// readEvents collects the events of an SSE stream until the server closes it
+func readEvents(t *testing.T, body io.Reader, events chan<- sseEvent) {
+	defer close(events)
+	scanner := bufio.NewScanner(body)
+	var event sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event.Data))
+		case line == "" && event.Name != "":
+			events <- event
+			event = sseEvent{}
+		}
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "stream closed")
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+		return sseEvent{}
+	}
+}
+
+func TestStreamJobEvents(t *testing.T) {
+	db := setupTestDB(t)
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	job := createJob(t, db, TypeExport, StatusPending)
+
+	resp, err := http.Get(server.URL + "/v1/jobs/" + job.ID.String() + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	events := make(chan sseEvent, 16)
+	go readEvents(t, resp.Body, events)
+
+	assert.Equal(t, "status", nextEvent(t, events).Name)
+	assert.Equal(t, "progress", nextEvent(t, events).Name)
+
+	// A worker picks the job up and flushes a batch
+	job.Status = StatusProcessing
+	job.TotalRows = 2000
+	PublishProgress(&job)
+	event := nextEvent(t, events)
+	assert.Equal(t, "status", event.Name)
+	assert.Equal(t, StatusPending, event.Data["previous_status"])
+	event = nextEvent(t, events)
+	assert.Equal(t, "progress", event.Name)
+	assert.EqualValues(t, 2000, event.Data["total_rows"])
+
+	job.ProcessedRows = 1000
+	PublishProgress(&job)
+	event = nextEvent(t, events)
+	assert.Equal(t, "progress", event.Name)
+	assert.EqualValues(t, 50, event.Data["progress"])
+
+	// The worker saves the final state, then announces it
+	finished := time.Now()
+	job.Status, job.ProcessedRows, job.FinishedAt = StatusCompleted, 2000, &finished
+	require.NoError(t, db.Model(&job).Updates(map[string]interface{}{
+		"status": job.Status, "processed_rows": job.ProcessedRows, "finished_at": finished,
+	}).Error)
+	PublishProgress(&job)
+
+	assert.Equal(t, "status", nextEvent(t, events).Name)
+	assert.Equal(t, "progress", nextEvent(t, events).Name)
+	event = nextEvent(t, events)
+	assert.Equal(t, "summary", event.Name)
+	assert.Equal(t, StatusCompleted, event.Data["status"])
+	assert.EqualValues(t, 2000, event.Data["processed_rows"])
+
+	_, open := <-events
+	assert.False(t, open, "stream ends after the summary")
+}
+
+func TestStreamJobEvents_FinishedJob(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter()
+
+	job := createJob(t, db, TypeImport, StatusFailed)
+	db.Model(&job).Update("finished_at", time.Now())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/jobs/"+job.ID.String()+"/events", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "event:summary")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/jobs/"+uuid.NewString()+"/events", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// webhookReceiver records the webhooks it gets, answering with the next status code in line (200 once exhausted)
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	codes    []int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	code := http.StatusOK
+	if len(r.codes) > 0 {
+		code, r.codes = r.codes[0], r.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func finishJob(t *testing.T, db *gorm.DB, job *Job, status string) {
+	now := time.Now()
+	job.Status, job.FinishedAt = status, &now
+	require.NoError(t, db.Model(job).Updates(map[string]interface{}{"status": status, "finished_at": now}).Error)
+}
+
+func TestWebhooks_SignedDeliveryToCallbackAndSubscription(t *testing.T) {
+	db := setupTestDB(t)
+	t.Setenv("WEBHOOK_SECRET", "callback-secret")
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sub := WebhookSubscription{URL: server.URL + "/all", Secret: "sub-secret"}
+	require.NoError(t, db.Create(&sub).Error)
+	importsOnly := WebhookSubscription{URL: server.URL + "/imports", JobType: TypeImport}
+	require.NoError(t, db.Create(&importsOnly).Error)
+
+	job := createJob(t, db, TypeExport, StatusProcessing)
+	db.Model(&job).Update("callback_url", server.URL+"/callback")
+
+	// Nothing to announce while the job runs
+	queued, err := QueueWebhooks(db, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, queued)
+
+	finishJob(t, db, &job, StatusCompleted)
+	queued, err = QueueWebhooks(db, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, queued)
+
+	// A second sweep (or another instance) doesn't queue the job again
+	queued, err = QueueWebhooks(db, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, queued)
+
+	delivered, err := DeliverWebhooks(context.Background(), db, server.Client(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+
+	secrets := map[string]string{"/callback": "callback-secret", "/all": "sub-secret"}
+	require.Len(t, receiver.requests, 2)
+	for i, req := range receiver.requests {
+		secret, ok := secrets[req.URL.Path]
+		require.True(t, ok, req.URL.Path)
+		assert.Equal(t, "job.completed", req.Header.Get(WebhookEventHeader))
+		expected := SignWebhook(secret, req.Header.Get(WebhookTimestampHeader), receiver.bodies[i])
+		assert.Equal(t, expected, req.Header.Get(WebhookSignatureHeader))
+
+		var payload WebhookPayload
+		require.NoError(t, json.Unmarshal(receiver.bodies[i], &payload))
+		assert.Equal(t, job.ID, payload.Job.JobID)
+		assert.Equal(t, StatusCompleted, payload.Job.Status)
+	}
+
+	var deliveries []WebhookDelivery
+	db.Find(&deliveries)
+	for _, d := range deliveries {
+		assert.Equal(t, DeliveryDelivered, d.Status)
+		assert.Equal(t, http.StatusOK, d.ResponseCode)
+		assert.NotNil(t, d.DeliveredAt)
+	}
+}
+
+func TestWebhooks_RetriesThenGivesUp(t *testing.T) {
+	db := setupTestDB(t)
+	t.Setenv("WEBHOOK_SECRET", "callback-secret")
+
+	receiver := &webhookReceiver{codes: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	job := createJob(t, db, TypeImport, StatusProcessing)
+	db.Model(&job).Update("callback_url", server.URL)
+	finishJob(t, db, &job, StatusFailed)
+
+	_, err := QueueWebhooks(db, time.Now())
+	require.NoError(t, err)
+
+	now := time.Now()
+	delivered, err := DeliverWebhooks(context.Background(), db, server.Client(), now)
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+
+	var delivery WebhookDelivery
+	require.NoError(t, db.First(&delivery, "job_id = ?", job.ID).Error)
+	assert.Equal(t, DeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, delivery.ResponseCode)
+	require.NotNil(t, delivery.NextAttemptAt)
+	assert.WithinDuration(t, now.Add(WebhookRetryBaseDelay), *delivery.NextAttemptAt, time.Second)
+
+	// Not due yet
+	delivered, _ = DeliverWebhooks(context.Background(), db, server.Client(), now)
+	assert.Zero(t, delivered)
+	assert.Len(t, receiver.requests, 1)
+
+	// Second attempt fails again, the third one goes through
+	DeliverWebhooks(context.Background(), db, server.Client(), now.Add(time.Minute))
+	delivered, _ = DeliverWebhooks(context.Background(), db, server.Client(), now.Add(5*time.Minute))
+	assert.Equal(t, 1, delivered)
+	assert.Len(t, receiver.requests, 3)
+	assert.Equal(t, "job.failed", receiver.requests[2].Header.Get(WebhookEventHeader))
+	assert.NotEmpty(t, receiver.requests[2].Header.Get(WebhookSignatureHeader))
+
+	// A receiver that never answers 2xx is given up on
+	receiver.codes = []int{500, 500, 500, 500, 500}
+	job2 := createJob(t, db, TypeImport, StatusProcessing)
+	db.Model(&job2).Update("callback_url", server.URL)
+	finishJob(t, db, &job2, StatusCancelled)
+	QueueWebhooks(db, time.Now())
+	for i := 0; i < WebhookMaxAttempts; i++ {
+		DeliverWebhooks(context.Background(), db, server.Client(), time.Now().Add(time.Duration(i)*time.Hour))
+	}
+	var failed WebhookDelivery
+	require.NoError(t, db.First(&failed, "job_id = ?", job2.ID).Error)
+	assert.Equal(t, DeliveryFailed, failed.Status)
+	assert.Equal(t, WebhookMaxAttempts, failed.Attempts)
+	assert.Contains(t, failed.LastError, "500")
+}
+
+func TestDeliverWebhooks_StopsWhenContextIsDone(t *testing.T) {
+	db := setupTestDB(t)
+	t.Setenv("WEBHOOK_SECRET", "callback-secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		cancel() // Shutdown starts while the first delivery is in flight
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		delivery := WebhookDelivery{JobID: uuid.New(), URL: server.URL, Event: "job.completed", Status: DeliveryPending, NextAttemptAt: &now}
+		require.NoError(t, db.Create(&delivery).Error)
+	}
+
+	delivered, err := DeliverWebhooks(ctx, db, server.Client(), now)
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+	assert.EqualValues(t, 1, calls.Load(), "no delivery is started after the stop signal")
+
+	var deliveries []WebhookDelivery
+	require.NoError(t, db.Find(&deliveries).Error)
+	for _, d := range deliveries {
+		assert.Equal(t, DeliveryPending, d.Status)
+		assert.Zero(t, d.Attempts, "an interrupted send doesn't use up an attempt")
+		assert.False(t, d.NextAttemptAt.After(time.Now()), "due again right away")
+	}
+}
+
+func TestClaimWebhookDelivery_LeasesOneAtATime(t *testing.T) {
+	db := setupTestDB(t)
+
+	now := time.Now()
+	deliveries := []WebhookDelivery{
+		{JobID: uuid.New(), URL: "https://example.com/a", Event: "job.completed", Status: DeliveryPending, NextAttemptAt: &now},
+		{JobID: uuid.New(), URL: "https://example.com/b", Event: "job.completed", Status: DeliveryPending, NextAttemptAt: &now},
+	}
+	require.NoError(t, db.Create(&deliveries).Error)
+
+	first, err := claimWebhookDelivery(db, now, nil)
+	require.NoError(t, err)
+
+	// Only the delivery about to be sent is leased, the rest stays claimable by other instances
+	second, err := claimWebhookDelivery(db, now, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+
+	_, err = claimWebhookDelivery(db, now, nil)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	var leased WebhookDelivery
+	require.NoError(t, db.First(&leased, "id = ?", first.ID).Error)
+	assert.WithinDuration(t, time.Now().Add(2*WebhookTimeout), *leased.NextAttemptAt, time.Second)
+}
+
+func TestWebhooks_CallbackNeverSentUnsigned(t *testing.T) {
+	db := setupTestDB(t)
+	t.Setenv("WEBHOOK_SECRET", "")
+
+	assert.ErrorContains(t, ValidateCallbackURL("https://93.184.215.14/hook"), "WEBHOOK_SECRET")
+
+	// A callback queued while the secret was set, delivered after it was removed
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	job := createJob(t, db, TypeExport, StatusProcessing)
+	db.Model(&job).Update("callback_url", server.URL)
+	finishJob(t, db, &job, StatusCompleted)
+	_, err := QueueWebhooks(db, time.Now())
+	require.NoError(t, err)
+
+	delivered, err := DeliverWebhooks(context.Background(), db, server.Client(), time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+	assert.Empty(t, receiver.requests)
+
+	var delivery WebhookDelivery
+	require.NoError(t, db.First(&delivery, "job_id = ?", job.ID).Error)
+	assert.Equal(t, DeliveryFailed, delivery.Status)
+	assert.Equal(t, "WEBHOOK_SECRET is not set", delivery.LastError)
+}
+
+func TestValidateWebhookURL_RejectsInternalTargets(t *testing.T) {
+	for _, raw := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		assert.ErrorContains(t, ValidateWebhookURL(raw), "private, loopback or link-local", raw)
+	}
+	assert.NoError(t, ValidateWebhookURL("https://93.184.215.14/hook"))
+
+	t.Setenv("WEBHOOK_ALLOWED_HOSTS", "receiver.internal, 10.0.0.5")
+	assert.NoError(t, ValidateWebhookURL("http://10.0.0.5/hook"))
+	assert.NoError(t, ValidateWebhookURL("http://receiver.internal/hook"))
+}
+
+func TestNewWebhookClient_RefusesInternalTargetsAtSendTime(t *testing.T) {
+	server := httptest.NewServer(&webhookReceiver{})
+	defer server.Close()
+
+	_, err := NewWebhookClient().Get(server.URL)
+	assert.ErrorContains(t, err, "not a public address")
+}
+
+func TestWebhookSubscription_Matches(t *testing.T) {
+	created := time.Now()
+	sub := WebhookSubscription{Statuses: []string{StatusFailed, StatusDeadLetter}, JobType: TypeImport, CreatedAt: created}
+
+	later := created.Add(time.Minute)
+	earlier := created.Add(-time.Minute)
+	assert.True(t, sub.Matches(&Job{Type: TypeImport, Status: StatusFailed, FinishedAt: &later}))
+	assert.False(t, sub.Matches(&Job{Type: TypeImport, Status: StatusCompleted, FinishedAt: &later}))
+	assert.False(t, sub.Matches(&Job{Type: TypeExport, Status: StatusFailed, FinishedAt: &later}))
+	assert.False(t, sub.Matches(&Job{Type: TypeImport, Status: StatusFailed, FinishedAt: &earlier}), "finished before subscribing")
+}
+
+func TestCreateImportJob_RejectsBadOptions(t *testing.T) {
+	setupTestDB(t)
+	router := setupTestRouter()
+	t.Setenv("WEBHOOK_SECRET", "")
+
+	tests := []struct {
+		field, value, message string
+	}{
+		{"callback_url", "ftp://example.com/hook", "callback_url"},
+		{"callback_url", "https://169.254.169.254/latest/meta-data", "private, loopback or link-local"},
+		{"callback_url", "https://93.184.215.14/hook", "no WEBHOOK_SECRET"},
+		{"mode", "preview", "mode must be import or validate"},
+		{"on_conflict", "merge", "on_conflict must be skip, update or fail"},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("resource", "users")
+		form.WriteField(tt.field, tt.value)
+		part, _ := form.CreateFormFile("file", "users.csv")
+		part.Write([]byte("id,email,name\n"))
+		form.Close()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/imports", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.field)
+		assert.Contains(t, w.Body.String(), tt.message)
+	}
+}
@@ -0,0 +1,453 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED" // Gave up after WebhookMaxAttempts
+)
+
+// Webhook delivery policy: WebhookRetryBaseDelay after the first failed attempt, doubling each time
+var (
+	WebhookMaxAttempts    = 5
+	WebhookRetryBaseDelay = 30 * time.Second
+	WebhookTimeout        = 10 * time.Second
+)
+
+// Headers sent with every webhook
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookSubscription receives the webhooks of every job reaching one of its statuses
+type WebhookSubscription struct {
+	ID       uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	URL      string    `gorm:"size:2048;not null" json:"url"`
+	Secret   string    `gorm:"size:255;not null" json:"-"`
+	Statuses []string  `gorm:"serializer:json" json:"statuses"` // Final statuses to notify, all of them when empty
+	JobType  string    `gorm:"size:20" json:"job_type,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Matches reports whether the subscription wants the webhook of a finished job
+func (s *WebhookSubscription) Matches(job *Job) bool {
+	if s.JobType != "" && s.JobType != job.Type {
+		return false
+	}
+	// Jobs that finished before the subscription existed are not announced to it
+	if job.FinishedAt != nil && job.FinishedAt.Before(s.CreatedAt) {
+		return false
+	}
+	if len(s.Statuses) == 0 {
+		return true
+	}
+	for _, status := range s.Statuses {
+		if status == job.Status {
+			return true
+		}
+	}
+	return false
+}
+
+// BeforeCreate is a GORM hook to generate UUIDs and a signing secret
+func (s *WebhookSubscription) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	if s.Secret == "" {
+		s.Secret, err = NewWebhookSecret()
+	}
+	return
+}
+
+// WebhookDelivery is one webhook sent (or to be sent) for a job. The table doubles as the delivery log.
+type WebhookDelivery struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;" json:"id"`
+	JobID          uuid.UUID  `gorm:"type:uuid;index;not null" json:"job_id"`
+	SubscriptionID *uuid.UUID `gorm:"type:uuid;index" json:"subscription_id,omitempty"` // nil for the job's own callback_url
+	URL            string     `gorm:"size:2048;not null" json:"url"`
+	Event          string     `gorm:"size:50;not null" json:"event"`
+	Payload        string     `gorm:"type:text" json:"-"`
+
+	Status        string     `gorm:"size:20;index;not null" json:"status"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at,omitempty"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	LastError     string     `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BeforeCreate is a GORM hook to generate UUIDs
+func (d *WebhookDelivery) BeforeCreate(tx *gorm.DB) (err error) {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return
+}
+
+// WebhookPayload is the JSON body of a webhook
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Job       JobResponse `json:"job"`
+}
+
+// WebhookEvent names the webhook sent for a job reaching status, e.g. "job.completed"
+func WebhookEvent(status string) string {
+	return "job." + strings.ToLower(status)
+}
+
+// ValidateWebhookURL checks the URL of a webhook subscription or callback.
+// Its host must resolve to public addresses only, unless listed in WEBHOOK_ALLOWED_HOSTS,
+// so webhooks can't be aimed at the server's own network (metadata endpoints, databases...).
+func ValidateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("must be an absolute http(s) URL")
+	}
+	host := u.Hostname()
+	if webhookHostAllowed(host) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("host %q could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return fmt.Errorf("must not point to a private, loopback or link-local address")
+		}
+	}
+	return nil
+}
+
+// webhookHostAllowed reports whether host is listed in WEBHOOK_ALLOWED_HOSTS (comma separated),
+// the receivers trusted to live on a private network
+func webhookHostAllowed(host string) bool {
+	for _, allowed := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicIP reports whether ip is routable on the internet, as opposed to loopback, RFC 1918,
+// link-local (169.254.169.254 among them), unspecified or multicast addresses
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// NewWebhookClient returns the HTTP client webhooks are sent with. The address check of
+// ValidateWebhookURL is repeated on every connection, redirects included, so a host that
+// resolved to a public address when it was registered can't be switched to a private one later.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: WebhookTimeout}
+	guarded := &net.Dialer{
+		Timeout: WebhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook target %s is not a public address", host)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && webhookHostAllowed(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// ValidateCallbackURL checks a callback_url given on job creation.
+// Callbacks are signed with WEBHOOK_SECRET, so they are refused while it isn't set.
+func ValidateCallbackURL(raw string) error {
+	if err := ValidateWebhookURL(raw); err != nil {
+		return fmt.Errorf("callback_url %v", err)
+	}
+	if callbackSecret() == "" {
+		return fmt.Errorf("callback_url is unavailable: the server has no WEBHOOK_SECRET to sign it with")
+	}
+	return nil
+}
+
+// callbackSecret signs the webhooks sent to the jobs' own callback_url
+func callbackSecret() string {
+	return os.Getenv("WEBHOOK_SECRET")
+}
+
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignWebhook computes the X-Webhook-Signature of a body sent at timestamp (unix seconds):
+// "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>"
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBatchSize caps how many jobs or deliveries a single sweep handles
+const webhookBatchSize = 100
+
+// QueueWebhooks creates the deliveries of finished jobs that haven't been announced yet: one for the
+// job's callback_url, plus one per matching subscription. Each job is only ever queued once, even with
+// several instances sweeping, as jobs are locked with SKIP LOCKED and flagged in the same transaction.
+func QueueWebhooks(db *gorm.DB, now time.Time) (int, error) {
+	queued := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var finished []Job
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("finished_at IS NOT NULL AND webhooks_queued_at IS NULL").
+			Order("finished_at ASC").
+			Limit(webhookBatchSize).
+			Find(&finished).Error
+		if err != nil || len(finished) == 0 {
+			return err
+		}
+
+		var subscriptions []WebhookSubscription
+		if err := tx.Find(&subscriptions).Error; err != nil {
+			return err
+		}
+
+		for i := range finished {
+			job := &finished[i]
+			var deliveries []WebhookDelivery
+			if job.CallbackURL != "" {
+				deliveries = append(deliveries, WebhookDelivery{URL: job.CallbackURL})
+			}
+			for _, sub := range subscriptions {
+				if sub.Matches(job) {
+					id := sub.ID
+					deliveries = append(deliveries, WebhookDelivery{URL: sub.URL, SubscriptionID: &id})
+				}
+			}
+
+			if len(deliveries) > 0 {
+				serializer := JobSerializer{Job: *job}
+				payload, err := json.Marshal(WebhookPayload{
+					Event:     WebhookEvent(job.Status),
+					CreatedAt: now,
+					Job:       serializer.Response(),
+				})
+				if err != nil {
+					return err
+				}
+				for j := range deliveries {
+					deliveries[j].JobID = job.ID
+					deliveries[j].Event = WebhookEvent(job.Status)
+					deliveries[j].Payload = string(payload)
+					deliveries[j].Status = DeliveryPending
+					deliveries[j].NextAttemptAt = &now
+				}
+				if err := tx.Create(&deliveries).Error; err != nil {
+					return err
+				}
+				queued += len(deliveries)
+			}
+
+			if err := tx.Model(&Job{}).Where("id = ?", job.ID).Update("webhooks_queued_at", now).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return queued, err
+}
+
+// DeliverWebhooks sends the deliveries that are due and records the outcome of each attempt.
+// Each delivery is leased for a little longer than WebhookTimeout right before it is sent, so other
+// instances skip it meanwhile, and it is picked up again soon if this one dies mid-way.
+// Once ctx is done no further delivery is started, and the one being sent is handed back as is.
+func DeliverWebhooks(ctx context.Context, db *gorm.DB, client *http.Client, now time.Time) (int, error) {
+	delivered := 0
+	var handled []uuid.UUID
+	for len(handled) < webhookBatchSize && ctx.Err() == nil {
+		delivery, err := claimWebhookDelivery(db, now, handled)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			break
+		}
+		if err != nil {
+			return delivered, err
+		}
+		handled = append(handled, delivery.ID)
+
+		if sendWebhook(ctx, db, client, delivery) {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// claimWebhookDelivery leases the most overdue delivery that wasn't already handled by this sweep
+func claimWebhookDelivery(db *gorm.DB, now time.Time, handled []uuid.UUID) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now)
+		if len(handled) > 0 {
+			query = query.Where("id NOT IN ?", handled)
+		}
+		if err := query.Order("next_attempt_at ASC").First(&delivery).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).
+			Update("next_attempt_at", time.Now().Add(2*WebhookTimeout)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// sendWebhook makes one attempt at a delivery, scheduling a retry or giving up when it fails
+func sendWebhook(ctx context.Context, db *gorm.DB, client *http.Client, delivery *WebhookDelivery) bool {
+	now := time.Now()
+
+	// Callback URLs are signed with WEBHOOK_SECRET, subscriptions with their own secret
+	secret := callbackSecret()
+	if delivery.SubscriptionID != nil {
+		var sub WebhookSubscription
+		if err := db.First(&sub, "id = ?", *delivery.SubscriptionID).Error; err != nil {
+			giveUpWebhook(db, delivery, "subscription deleted", now)
+			return false
+		}
+		secret = sub.Secret
+	}
+	// Never send a payload the receiver can't authenticate
+	if secret == "" {
+		giveUpWebhook(db, delivery, "WEBHOOK_SECRET is not set", now)
+		return false
+	}
+
+	code, err := postWebhook(ctx, client, delivery, secret)
+	if ctx.Err() != nil {
+		// Interrupted by a shutdown rather than failed: due again right away, without using up an attempt
+		db.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).Update("next_attempt_at", now)
+		return false
+	}
+	delivery.Attempts++
+	delivery.ResponseCode = code
+
+	updates := map[string]interface{}{
+		"attempts":      delivery.Attempts,
+		"response_code": code,
+		"updated_at":    now,
+	}
+	switch {
+	case err == nil:
+		updates["status"] = DeliveryDelivered
+		updates["delivered_at"] = now
+		updates["next_attempt_at"] = nil
+		updates["last_error"] = ""
+	case delivery.Attempts >= WebhookMaxAttempts:
+		log.Printf("[Webhooks] Giving up on delivery %s to %s after %d attempts: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+		updates["status"] = DeliveryFailed
+		updates["next_attempt_at"] = nil
+		updates["last_error"] = err.Error()
+	default:
+		delay := WebhookRetryBaseDelay << (delivery.Attempts - 1)
+		updates["next_attempt_at"] = now.Add(delay)
+		updates["last_error"] = err.Error()
+	}
+
+	if err := db.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; err != nil {
+		log.Printf("[Webhooks] Could not record delivery %s: %v", delivery.ID, err)
+	}
+	return err == nil
+}
+
+// giveUpWebhook fails a delivery without sending it
+func giveUpWebhook(db *gorm.DB, delivery *WebhookDelivery, reason string, now time.Time) {
+	db.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":          DeliveryFailed,
+		"next_attempt_at": nil,
+		"last_error":      reason,
+		"updated_at":      now,
+	})
+}
+
+// postWebhook sends the signed payload, any non-2xx answer counts as a failure
+func postWebhook(ctx context.Context, client *http.Client, delivery *WebhookDelivery, secret string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, WebhookTimeout)
+	defer cancel()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID.String())
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
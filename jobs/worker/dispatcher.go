@@ -1,7 +1,13 @@
 package worker
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
@@ -10,27 +16,268 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-// StartWorker initializes the background job processor
-func StartWorker() {
+// ErrShutdown is the cancellation cause of a job still running when the drain timeout runs out
+var ErrShutdown = errors.New("worker shutting down")
+
+// PoolConfig controls how many workers claim jobs of each type.
+// Each job type gets its own set of workers, so a slow import can never
+// occupy the slots reserved for exports (and vice versa).
+type PoolConfig struct {
+	// Concurrency is the number of workers per job type, e.g. {jobs.TypeImport: 2}
+	Concurrency map[string]int
+	// Notifier wakes idle workers when a job is queued (jobs.GetNotifier() when nil)
+	Notifier jobs.Notifier
+	// PollInterval is the fallback sweep: how long an idle worker waits without a
+	// notification before checking the queue anyway (retries, missed notifications...)
+	PollInterval time.Duration
+
+	// LeaseDuration is how long a job may go without a heartbeat before it is reaped
+	LeaseDuration time.Duration
+	// HeartbeatInterval is how often a running job refreshes its lease
+	HeartbeatInterval time.Duration
+	// ReapInterval is how often expired leases are looked for
+	ReapInterval time.Duration
+
+	// ScheduleInterval is how often due export schedules are turned into jobs
+	ScheduleInterval time.Duration
+	// WebhookInterval is how often finished jobs are announced and due webhooks sent
+	WebhookInterval time.Duration
+}
+
+// DefaultPoolConfig reads the pool size from the environment:
+// WORKER_IMPORT_CONCURRENCY (default 1), WORKER_EXPORT_CONCURRENCY (default 2),
+// WORKER_POLL_SECONDS (default 10), WORKER_LEASE_SECONDS (default 60),
+// WORKER_SCHEDULE_SECONDS (default 30) and WORKER_WEBHOOK_SECONDS (default 5).
+func DefaultPoolConfig() PoolConfig {
+	lease := time.Duration(envInt("WORKER_LEASE_SECONDS", 60)) * time.Second
+	return PoolConfig{
+		Concurrency: map[string]int{
+			jobs.TypeImport: envInt("WORKER_IMPORT_CONCURRENCY", 1),
+			jobs.TypeExport: envInt("WORKER_EXPORT_CONCURRENCY", 2),
+		},
+		PollInterval:      time.Duration(envInt("WORKER_POLL_SECONDS", 10)) * time.Second,
+		LeaseDuration:     lease,
+		HeartbeatInterval: lease / 4,
+		ReapInterval:      lease / 2,
+		ScheduleInterval:  time.Duration(envInt("WORKER_SCHEDULE_SECONDS", 30)) * time.Second,
+		WebhookInterval:   time.Duration(envInt("WORKER_WEBHOOK_SECONDS", 5)) * time.Second,
+	}
+}
+
+// Pool runs a fixed number of workers per job type
+type Pool struct {
+	config PoolConfig
+	handle func(ctx context.Context, job *jobs.Job)
+
+	// wake holds one pending wake-up per idle worker of each job type
+	wake         map[string]chan struct{}
+	stopListener context.CancelFunc
+
+	// jobsCtx is the parent of every running job's context, cancelled with ErrShutdown
+	// when the drain timeout runs out
+	jobsCtx       context.Context
+	interruptJobs context.CancelCauseFunc
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewPool(config PoolConfig) *Pool {
+	if config.Notifier == nil {
+		config.Notifier = jobs.GetNotifier()
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = 10 * time.Second
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = 60 * time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = config.LeaseDuration / 4
+	}
+	if config.ReapInterval <= 0 {
+		config.ReapInterval = config.LeaseDuration / 2
+	}
+	if config.ScheduleInterval <= 0 {
+		config.ScheduleInterval = 30 * time.Second
+	}
+	if config.WebhookInterval <= 0 {
+		config.WebhookInterval = 5 * time.Second
+	}
+	wake := make(map[string]chan struct{})
+	for jobType, n := range config.Concurrency {
+		wake[jobType] = make(chan struct{}, n)
+	}
+	jobsCtx, interruptJobs := context.WithCancelCause(context.Background())
+	return &Pool{
+		config:        config,
+		handle:        executeJob,
+		wake:          wake,
+		stopListener:  func() {},
+		jobsCtx:       jobsCtx,
+		interruptJobs: interruptJobs,
+		stop:          make(chan struct{}),
+	}
+}
+
+// StartWorker initializes the background job processor with the default pool configuration
+func StartWorker() *Pool {
+	pool := NewPool(DefaultPoolConfig())
+	pool.Start()
+	return pool
+}
+
+// Start launches the workers for every configured job type, plus the lease reaper,
+// the export scheduler, the webhook sender and the notification listener
+func (p *Pool) Start() {
+	p.listen()
+
+	for jobType, n := range p.config.Concurrency {
+		for i := 0; i < n; i++ {
+			p.wg.Add(1)
+			go p.run(jobType, newWorkerID(jobType, i))
+		}
+		log.Printf("[Worker] Started %d worker(s) for %s jobs", n, jobType)
+	}
+
+	p.wg.Add(3)
+	go p.reap()
+	go p.schedule()
+	go p.webhooks()
+}
+
+// Stop tells the workers to stop claiming jobs and waits for the current ones to finish
+func (p *Pool) Stop() {
+	p.Shutdown(context.Background())
+}
+
+// Shutdown tells the workers to stop claiming jobs and waits for the current ones to finish.
+// If ctx is done first, the running jobs are interrupted at their next batch boundary and
+// handed back to the queue, and ctx's error is returned once they have been released.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		p.stopListener()
+		close(p.stop)
+	})
+
+	drained := make(chan struct{})
 	go func() {
-		log.Println("[Worker] Started background job processor")
-		for {
-			processNextJob()
-			// Poll every 1 second to avoid hammering the DB
-			time.Sleep(1 * time.Second)
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Printf("[Worker] Drain timeout reached, returning running jobs to the queue")
+	p.interruptJobs(ErrShutdown)
+	<-drained
+	return ctx.Err()
+}
+
+// listen forwards job notifications to the idle workers of the matching type.
+// If listening fails the pool still works, only with the fallback sweep's latency.
+func (p *Pool) listen() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopListener = cancel
+
+	notifications, err := p.config.Notifier.Listen(ctx)
+	if err != nil {
+		log.Printf("[Worker] Job notifications unavailable, polling every %s: %v", p.config.PollInterval, err)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for jobType := range notifications {
+			p.wakeUp(jobType)
 		}
 	}()
 }
 
-func processNextJob() {
-	db := common.GetDB()
+// wakeUp nudges one idle worker of the given type, if it isn't already due to wake up
+func (p *Pool) wakeUp(jobType string) {
+	select {
+	case p.wake[jobType] <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) run(jobType, workerID string) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep claiming while there is work, only sleep once the queue is empty
+		for !p.stopped() && p.processNextJob(jobType, workerID) {
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake[jobType]:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNextJob claims and executes one job of the given type.
+// It returns false when there was nothing to do.
+func (p *Pool) processNextJob(jobType, workerID string) bool {
+	job, err := claimNextJob(common.GetDB(), jobType, workerID)
+
+	// If no job found (RecordNotFound), just return and wait for next tick
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("[Worker] Error polling job: %v", err)
+		}
+		return false
+	}
+
+	// Job found! Hand it off to the processor
+	log.Printf("[Worker] %s picked up Job %s (%s %s, attempt %d)", workerID, job.ID, job.Type, job.Resource, job.Attempts)
+
+	// The heartbeat cancels ctx when the job is cancelled or the lease is lost,
+	// Shutdown cancels it when the drain timeout runs out
+	ctx, cancel := context.WithCancelCause(p.jobsCtx)
+	defer cancel(nil)
+	stopHeartbeat := p.heartbeat(job, cancel)
+	defer stopHeartbeat()
+
+	jobs.PublishProgress(job)
+	p.handle(ctx, job)
+	return true
+}
+
+// claimNextJob finds the most urgent PENDING job of the given type that is due (highest priority,
+// then oldest), marks it PROCESSING and records workerID as the lease owner
+func claimNextJob(db *gorm.DB, jobType, workerID string) (*jobs.Job, error) {
 	var job jobs.Job
 
 	// TRANSACTION: Find a PENDING job and lock it
 	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
 		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
-			Where("status = ?", jobs.StatusPending).
-			Order("created_at ASC").
+			Where("status = ? AND type = ?", jobs.StatusPending, jobType).
+			Where("run_at IS NULL OR run_at <= ?", now).
+			Where("next_run_at IS NULL OR next_run_at <= ?", now).
+			Order("priority DESC, created_at ASC").
 			First(&job)
 
 		if result.Error != nil {
@@ -38,24 +285,52 @@ func processNextJob() {
 			return result.Error
 		}
 
-		// Immediately mark as PROCESSING inside the transaction
-		job.Status = jobs.StatusProcessing
-		if err := tx.Save(&job).Error; err != nil {
-			return err
+		// Immediately mark as PROCESSING inside the transaction.
+		// The status guard keeps the claim exclusive on databases without SKIP LOCKED.
+		claim := tx.Model(&jobs.Job{}).
+			Where("id = ? AND status = ?", job.ID, jobs.StatusPending).
+			Updates(map[string]interface{}{
+				"status":       jobs.StatusProcessing,
+				"worker_id":    workerID,
+				"heartbeat_at": now,
+				"started_at":   now,
+				"finished_at":  nil,
+				"attempts":     gorm.Expr("attempts + 1"),
+				"updated_at":   now,
+			})
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
 		}
 
+		job.Status = jobs.StatusProcessing
+		job.WorkerID = workerID
+		job.HeartbeatAt = &now
+		job.StartedAt = &now
+		job.FinishedAt = nil
+		job.Attempts++
 		return nil
 	})
-
-	// If no job found (RecordNotFound), just return and wait for next tick
 	if err != nil {
-		if err != gorm.ErrRecordNotFound {
-			log.Printf("[Worker] Error polling job: %v", err)
-		}
-		return
+		return nil, err
 	}
+	return &job, nil
+}
 
-	// Job found! Hand it off to the processor
-	log.Printf("[Worker] Picked up Job %s (%s %s)", job.ID, job.Type, job.Resource)
-	executeJob(&job)
+// newWorkerID identifies a single worker goroutine across every running instance
+func newWorkerID(jobType string, index int) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s-%d", host, os.Getpid(), jobType, index)
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
 }
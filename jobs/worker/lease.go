@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"gorm.io/gorm"
+)
+
+// ErrLeaseLost is the cancellation cause of a job that was reaped or taken over by another worker
+var ErrLeaseLost = errors.New("job lease lost")
+
+// heartbeat refreshes the lease of a running job until the returned stop function is called.
+// When the lease can't be renewed, cancel is called with jobs.ErrJobCancelled or ErrLeaseLost.
+func (p *Pool) heartbeat(job *jobs.Job, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(p.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				db := common.GetDB()
+				owned, err := renewLease(db, job)
+				if err != nil {
+					log.Printf("[Worker] Heartbeat failed for Job %s: %v", job.ID, err)
+				} else if !owned {
+					cause := leaseLostCause(db, job)
+					log.Printf("[Worker] Stopping Job %s: %v", job.ID, cause)
+					cancel(cause)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// renewLease bumps the heartbeat of a job this worker still owns.
+// It reports false when the job was reaped or handed to another worker.
+func renewLease(db *gorm.DB, job *jobs.Job) (bool, error) {
+	now := time.Now()
+	result := db.Model(&jobs.Job{}).
+		Where("id = ? AND worker_id = ? AND status = ?", job.ID, job.WorkerID, jobs.StatusProcessing).
+		Update("heartbeat_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	job.HeartbeatAt = &now
+	return true, nil
+}
+
+// leaseLostCause tells a user cancellation apart from a lease taken over by the reaper
+func leaseLostCause(db *gorm.DB, job *jobs.Job) error {
+	var current jobs.Job
+	if err := db.Select("status", "worker_id").First(&current, "id = ?", job.ID).Error; err == nil &&
+		current.Status == jobs.StatusCancelled && current.WorkerID == job.WorkerID {
+		return jobs.ErrJobCancelled
+	}
+	return ErrLeaseLost
+}
+
+// reap periodically returns jobs with expired leases to the queue
+func (p *Pool) reap() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			requeued, deadLettered, err := reapExpiredLeases(common.GetDB(), time.Now().Add(-p.config.LeaseDuration))
+			if err != nil {
+				log.Printf("[Worker] Reaper error: %v", err)
+			} else if requeued > 0 || deadLettered > 0 {
+				log.Printf("[Worker] Reaper: %d job(s) re-queued, %d job(s) dead-lettered after expired leases", requeued, deadLettered)
+				for jobType := range p.wake {
+					p.wakeUp(jobType)
+				}
+			}
+			finished, err := finishAbandonedCancellations(common.GetDB(), time.Now().Add(-p.config.LeaseDuration))
+			if err != nil {
+				log.Printf("[Worker] Reaper error: %v", err)
+			} else if finished > 0 {
+				log.Printf("[Worker] Reaper: %d cancelled job(s) finished after expired leases", finished)
+			}
+		}
+	}
+}
+
+// expiredLease matches jobs in a status whose heartbeat is older than the cutoff.
+// Jobs claimed before leases existed have no heartbeat, so updated_at is used instead.
+const expiredLease = "status = ? AND (heartbeat_at < ? OR (heartbeat_at IS NULL AND updated_at < ?))"
+
+// reapExpiredLeases re-queues PROCESSING jobs whose last heartbeat is older than cutoff,
+// or dead-letters them once they have used up their attempts.
+func reapExpiredLeases(db *gorm.DB, cutoff time.Time) (requeued, deadLettered int64, err error) {
+	result := db.Model(&jobs.Job{}).
+		Where(expiredLease, jobs.StatusProcessing, cutoff, cutoff).
+		Where("attempts >= max_attempts").
+		Updates(map[string]interface{}{
+			"status":        jobs.StatusDeadLetter,
+			"error_message": "lease expired on the last attempt",
+			"finished_at":   time.Now(),
+		})
+	if result.Error != nil {
+		return 0, 0, result.Error
+	}
+	deadLettered = result.RowsAffected
+
+	result = db.Model(&jobs.Job{}).
+		Where(expiredLease, jobs.StatusProcessing, cutoff, cutoff).
+		Where("attempts < max_attempts").
+		Update("status", jobs.StatusPending)
+	if result.Error != nil {
+		return 0, deadLettered, result.Error
+	}
+	return result.RowsAffected, deadLettered, nil
+}
+
+// finishAbandonedCancellations finishes the jobs cancelled while PROCESSING whose worker stopped
+// heartbeating before it could. Their lease expired, so no worker will: they are set a FinishedAt,
+// which ends their event streams and queues their webhooks.
+func finishAbandonedCancellations(db *gorm.DB, cutoff time.Time) (int64, error) {
+	result := db.Model(&jobs.Job{}).
+		Where(expiredLease, jobs.StatusCancelled, cutoff, cutoff).
+		Where("finished_at IS NULL").
+		Update("finished_at", time.Now())
+	return result.RowsAffected, result.Error
+}
@@ -3,6 +3,7 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,57 +13,204 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"github.com/gothinkster/golang-gin-realworld-example-app/jobs/core"
-	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"gorm.io/gorm"
 )
 
+// Retry backoff: RetryBaseDelay after the first failed attempt, doubling up to RetryMaxDelay
+var (
+	RetryBaseDelay = 30 * time.Second
+	RetryMaxDelay  = 15 * time.Minute
+)
+
+// retryDelay returns how long to wait before the next attempt after `attempt` failed
+func retryDelay(attempt int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < attempt && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	return delay
+}
+
 // executeJob is the main entry point for the worker to process a job
-func executeJob(job *jobs.Job) {
+func executeJob(ctx context.Context, job *jobs.Job) {
 	db := common.GetDB()
 	var err error
 
+	// Every attempt starts counting from scratch
+	job.ProcessedRows = 0
+	job.FailedRows = 0
+	job.InsertedRows = 0
+	job.UpdatedRows = 0
+	job.SkippedRows = 0
+	job.BytesRead = 0
+	job.NextRunAt = nil
+
 	// Route based on Job Type
 	switch job.Type {
 	case jobs.TypeImport:
-		err = core.ProcessImport(job)
+		err = core.ProcessImport(ctx, job)
 	case jobs.TypeExport:
-		err = processExport(job)
+		err = processExport(ctx, job)
 	default:
-		err = fmt.Errorf("unknown job type: %s", job.Type)
+		err = jobs.Permanent(fmt.Errorf("unknown job type: %s", job.Type))
+	}
+
+	cause := context.Cause(ctx)
+	if errors.Is(cause, ErrLeaseLost) {
+		// Someone else owns the job now, leave the row alone
+		log.Printf("[Worker] Job %s abandoned: %v", job.ID, cause)
+		return
+	}
+	if errors.Is(cause, ErrShutdown) && err != nil {
+		// Interrupted by a deploy, not by a failure: hand it back without using up an attempt
+		if err := releaseJob(db, job); err != nil {
+			log.Printf("[Worker] Could not release Job %s: %v", job.ID, err)
+		} else {
+			log.Printf("[Worker] Job %s returned to the queue after %d rows", job.ID, job.ProcessedRows)
+			jobs.PublishProgress(job)
+		}
+		return
 	}
 
 	// Update Final Status
-	if err != nil {
-		log.Printf("[Worker] Job %s FAILED: %v", job.ID, err)
-		job.Status = jobs.StatusFailed
-		job.ErrorMessage = err.Error()
+	if errors.Is(cause, jobs.ErrJobCancelled) {
+		log.Printf("[Worker] Job %s CANCELLED after %d rows", job.ID, job.ProcessedRows)
+		job.Status = jobs.StatusCancelled
+	} else if err != nil {
+		failJob(job, err)
 	} else {
 		log.Printf("[Worker] Job %s COMPLETED", job.ID)
 		job.Status = jobs.StatusCompleted
+		job.ErrorMessage = ""
 
 		// For exports, ensure the final TotalRows matches exactly what was processed
 		// (This overwrites the estimate we made at the start of processExport)
 		if job.Type == jobs.TypeExport {
 			job.TotalRows = job.ProcessedRows
+		} else {
+			job.TotalRows = job.ProcessedRows + job.FailedRows + job.SkippedRows
 		}
 	}
 
-	job.UpdatedAt = time.Now()
-	db.Save(job)
+	now := time.Now()
+	job.UpdatedAt = now
+	if job.Status != jobs.StatusPending {
+		job.FinishedAt = &now
+	}
+	if err := saveOwnedJob(db, job); err != nil {
+		log.Printf("[Worker] Could not save final state of Job %s: %v", job.ID, err)
+		return
+	}
+	jobs.PublishProgress(job)
+}
+
+// failJob applies the retry policy: permanent errors fail the job straight away, transient ones
+// put it back in the queue with an exponential backoff until its attempts run out. A job cancelled
+// meanwhile is not re-queued: saveOwnedJob only writes the outcome of a job still PROCESSING.
+func failJob(job *jobs.Job, err error) {
+	job.ErrorMessage = err.Error()
+	switch {
+	case !jobs.IsRetryable(err):
+		log.Printf("[Worker] Job %s FAILED: %v", job.ID, err)
+		job.Status = jobs.StatusFailed
+	case job.Attempts < job.MaxAttempts:
+		nextRun := time.Now().Add(retryDelay(job.Attempts))
+		log.Printf("[Worker] Job %s attempt %d/%d failed, retrying at %s: %v",
+			job.ID, job.Attempts, job.MaxAttempts, nextRun.Format(time.RFC3339), err)
+		job.Status = jobs.StatusPending
+		job.NextRunAt = &nextRun
+	default:
+		log.Printf("[Worker] Job %s DEAD_LETTER after %d attempts: %v", job.ID, job.Attempts, err)
+		job.Status = jobs.StatusDeadLetter
+	}
 }
 
-type ExportConfig struct {
-	Format  string            `json:"format"`
-	Filters map[string]string `json:"filters"`
+// saveOwnedJob writes the whole job row, but only while this worker still holds the lease on a
+// PROCESSING job. A job that was reaped and picked up by someone else is left untouched. A job
+// cancelled since the last heartbeat stays CANCELLED, whatever its outcome: only its finish is
+// recorded, see finishCancelledJob.
+func saveOwnedJob(db *gorm.DB, job *jobs.Job) error {
+	result := db.Model(job).
+		Select("*").
+		Where("worker_id = ? AND status = ?", job.WorkerID, jobs.StatusProcessing).
+		Updates(job)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	return finishCancelledJob(db, job)
+}
+
+// finishCancelledJob records the finish of a job this worker held until it was cancelled: when
+// it stopped and the rows it got through, along with the error report of an import. The status
+// stays CANCELLED, so a cancelled job is never completed, failed or re-queued.
+func finishCancelledJob(db *gorm.DB, job *jobs.Job) error {
+	now := time.Now()
+	result := db.Model(&jobs.Job{}).
+		Where("id = ? AND worker_id = ? AND status = ?", job.ID, job.WorkerID, jobs.StatusCancelled).
+		Updates(map[string]interface{}{
+			"total_rows":     job.TotalRows,
+			"processed_rows": job.ProcessedRows,
+			"failed_rows":    job.FailedRows,
+			"inserted_rows":  job.InsertedRows,
+			"updated_rows":   job.UpdatedRows,
+			"skipped_rows":   job.SkippedRows,
+			"result_key":     job.ResultKey,
+			"finished_at":    now,
+			"updated_at":     now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("lease on job %s is no longer held by %s", job.ID, job.WorkerID)
+	}
+	job.Status = jobs.StatusCancelled
+	job.NextRunAt = nil
+	job.FinishedAt = &now
+	job.UpdatedAt = now
+	return nil
+}
+
+// releaseJob puts a job interrupted by a shutdown back to PENDING, giving back the attempt it was
+// claimed with, as long as this worker still holds the lease. Imports resume from their checkpoint.
+func releaseJob(db *gorm.DB, job *jobs.Job) error {
+	result := db.Model(&jobs.Job{}).
+		Where("id = ? AND worker_id = ? AND status = ?", job.ID, job.WorkerID, jobs.StatusProcessing).
+		Updates(map[string]interface{}{
+			"status":         jobs.StatusPending,
+			"attempts":       gorm.Expr("attempts - 1"),
+			"processed_rows": job.ProcessedRows,
+			"failed_rows":    job.FailedRows,
+			"inserted_rows":  job.InsertedRows,
+			"updated_rows":   job.UpdatedRows,
+			"skipped_rows":   job.SkippedRows,
+			"checkpoint":     job.Checkpoint,
+			"updated_at":     time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("lease on job %s is no longer held by %s", job.ID, job.WorkerID)
+	}
+	job.Status = jobs.StatusPending
+	job.Attempts--
+	return nil
 }
 
 // processExport handles the export logic: DB -> Stream -> S3 (Zero Disk Usage)
-func processExport(job *jobs.Job) error {
+func processExport(ctx context.Context, job *jobs.Job) error {
 	// Parse the SourceKey (contains JSON config)
-	var config ExportConfig
+	var config jobs.ExportConfig
 
 	// Try parsing JSON first
 	if err := json.Unmarshal([]byte(job.SourceKey), &config); err != nil {
@@ -82,50 +230,43 @@ func processExport(job *jobs.Job) error {
 
 	// Validate format
 	if config.Format != "ndjson" && config.Format != "csv" && config.Format != "json" {
-		return fmt.Errorf("invalid format: %s (must be ndjson, csv, or json)", config.Format)
+		return jobs.Permanent(fmt.Errorf("invalid format: %s (must be ndjson, csv, or json)", config.Format))
 	}
 
-	log.Printf("[Worker] ✓ Export started: Job %s, Resource: %s, Format: %s, Filters: %v",
-		job.ID, job.Resource, config.Format, config.Filters)
+	log.Printf("[Worker] ✓ Export started: Job %s, Resource: %s, Format: %s, Filter: %q, Filters: %v, Expand: %v",
+		job.ID, job.Resource, config.Format, config.Filter, config.Filters, config.Expand)
 
 	// ---------------------------------------------------------
 	// 1. Estimate Total Rows (Update DB for Progress Tracking)
 	// ---------------------------------------------------------
 	db := common.GetDB()
-	var totalCount int64
 
-	switch job.Resource {
-	case "users":
-		countQuery := db.Model(&users.UserModel{})
-		if username, ok := config.Filters["username"]; ok && username != "" {
-			countQuery = countQuery.Where("username = ?", username)
-		}
-		countQuery.Count(&totalCount)
-	case "articles":
-		countQuery := db.Model(&articles.ArticleModel{})
-		if author, ok := config.Filters["author"]; ok && author != "" {
-			var user users.UserModel
-			if err := db.Where("username = ?", author).First(&user).Error; err == nil {
-				countQuery = countQuery.Where("author_id = ?", user.ID)
-			}
-		}
-		if slug, ok := config.Filters["slug"]; ok && slug != "" {
-			countQuery = countQuery.Where("slug = ?", slug)
-		}
-		countQuery.Count(&totalCount)
-	case "comments":
-		countQuery := db.Model(&articles.CommentModel{})
-		if articleSlug, ok := config.Filters["article"]; ok && articleSlug != "" {
-			var art articles.ArticleModel
-			if err := db.Where("slug = ?", articleSlug).First(&art).Error; err == nil {
-				countQuery = countQuery.Where("article_id = ?", art.ID)
-			}
-		}
-		countQuery.Count(&totalCount)
+	// Counting and streaming read the same snapshot, rows written meanwhile are left for the next export
+	snapshot, snapshotAt, err := core.BeginSnapshot(db)
+	if err != nil {
+		return fmt.Errorf("failed to start export snapshot: %w", err)
+	}
+	defer snapshot.Rollback()
+	job.SnapshotAt = &snapshotAt
+	db.Model(job).Update("snapshot_at", job.SnapshotAt)
+
+	options := core.ExportOptions{
+		Format:  config.Format,
+		Filter:  config.Filter,
+		Filters: config.Filters,
+		Expand:  config.Expand,
+		Fields:  config.Fields,
+		Since:   config.Since,
+		DB:      snapshot,
+	}
+	// The same filter selects the rows counted and the ones streamed
+	totalCount, err := core.CountExport(job.Resource, options)
+	if err != nil {
+		return fmt.Errorf("failed to count rows to export: %w", err)
 	}
 
 	job.TotalRows = int(totalCount)
-	db.Save(job) // Update job with estimated total immediately
+	db.Model(job).Update("total_rows", job.TotalRows) // Update job with estimated total immediately
 	log.Printf("[Worker] ✓ Estimated %d total rows to export", totalCount)
 
 	// ---------------------------------------------------------
@@ -136,12 +277,17 @@ func processExport(job *jobs.Job) error {
 
 	var exportErr error
 	var rowCount int
+	streamDone := make(chan struct{})
+
+	options.OnProgress = exportProgress(job)
 
 	// Goroutine: Stream from DB to Pipe
 	go func() {
+		defer close(streamDone)
 		defer pw.Close() // Close writer when done so S3 knows stream ended
 
-		rows, err := core.StreamExport(job.Resource, config.Format, config.Filters, pw)
+		rows, err := core.StreamExport(ctx, job.Resource, options, pw)
+		rowCount = rows
 		if err != nil {
 			exportErr = err
 			// Close with error so the S3 reader knows something went wrong
@@ -150,7 +296,6 @@ func processExport(job *jobs.Job) error {
 			return
 		}
 
-		rowCount = rows
 		log.Printf("[Worker] ✓ Streaming complete: %d rows written to pipe", rows)
 	}()
 
@@ -160,16 +305,21 @@ func processExport(job *jobs.Job) error {
 	key := fmt.Sprintf("exports/%s/%s-%s.%s", job.Resource, job.Resource, job.ID, config.Format)
 
 	startUpload := time.Now()
-	_, err := common.GetS3().PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = common.GetS3().PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(os.Getenv("S3_BUCKET")),
 		Key:    aws.String(key),
 		Body:   pr, // Stream directly from pipe (No temp file created!)
 	})
 	uploadDuration := time.Since(startUpload)
 
+	// Unblock the streamer if the upload gave up early, then wait for it
+	pr.Close()
+	<-streamDone
+	job.ProcessedRows = rowCount
+
 	// Check for errors from the streamer goroutine
 	if exportErr != nil {
-		return fmt.Errorf("export streaming error: %v", exportErr)
+		return fmt.Errorf("export streaming error: %w", exportErr)
 	}
 
 	// Check for errors from S3 upload
@@ -178,8 +328,8 @@ func processExport(job *jobs.Job) error {
 	}
 
 	// Success!
-	job.ProcessedRows = rowCount
 	job.ResultKey = key
+	job.NextCursor = core.NextCursor(job.Resource, snapshotAt) // The next incremental export picks up every change the snapshot missed
 
 	log.Printf("[Worker] ✓ Export completed successfully:")
 	log.Printf("    - Resource: %s", job.Resource)
@@ -190,3 +340,20 @@ func processExport(job *jobs.Job) error {
 
 	return nil
 }
+
+// exportProgress is the OnProgress of a job's export. It publishes the rows written so far and, like
+// imports, writes them to the job row at most every jobs.ProgressFlushInterval. It works on its own
+// copy of the job, the job itself is only updated once the export is done.
+func exportProgress(job *jobs.Job) func(rows int) {
+	progress := *job
+	return func(rows int) {
+		progress.ProcessedRows = rows
+		jobs.PublishProgress(&progress)
+		if time.Since(progress.UpdatedAt) < jobs.ProgressFlushInterval {
+			return
+		}
+		if err := jobs.SaveProgress(common.GetDB(), &progress); err != nil {
+			log.Printf("[Worker] Could not save progress of Job %s: %v", job.ID, err)
+		}
+	}
+}
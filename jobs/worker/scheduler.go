@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs/core"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// schedule periodically turns due export schedules into jobs
+func (p *Pool) schedule() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.ScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			created, err := enqueueDueSchedules(common.GetDB(), time.Now())
+			if err != nil {
+				log.Printf("[Worker] Scheduler error: %v", err)
+			}
+			for _, job := range created {
+				log.Printf("[Worker] Scheduler queued Job %s (%s %s)", job.ID, job.Type, job.Resource)
+				jobs.NotifyQueued(context.Background(), job)
+			}
+		}
+	}
+}
+
+// scheduleBatchSize caps how many schedules a single sweep handles
+const scheduleBatchSize = 100
+
+// enqueueDueSchedules creates one export job per enabled schedule whose next run is due and moves
+// the schedule on to its next firing after now. Missed firings are not caught up on.
+//
+// Several instances may sweep at once: the schedules are locked with SKIP LOCKED, and the job's
+// idempotency key is derived from the schedule and the firing time, so a firing is never queued twice.
+func enqueueDueSchedules(db *gorm.DB, now time.Time) ([]jobs.Job, error) {
+	var created []jobs.Job
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var due []jobs.Schedule
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("enabled = ? AND next_run_at <= ?", true, now).
+			Order("next_run_at ASC").
+			Limit(scheduleBatchSize).
+			Find(&due).Error
+		if err != nil {
+			return err
+		}
+
+		for _, schedule := range due {
+			updates := map[string]interface{}{"updated_at": now}
+
+			var since *time.Time
+			if schedule.Incremental {
+				if since, err = scheduledSince(tx, schedule); err != nil {
+					return err
+				}
+			}
+			job := jobs.NewExportJob(schedule.Resource, schedule.ExportConfig(since),
+				fmt.Sprintf("%s%d", schedule.JobKeyPrefix(), schedule.NextRunAt.Unix()))
+			job.Priority = schedule.Priority
+
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&job)
+			if result.Error != nil {
+				return result.Error
+			}
+			// No row means another instance already queued this firing
+			if result.RowsAffected > 0 {
+				created = append(created, job)
+				updates["last_run_at"] = now
+				updates["last_job_id"] = job.ID
+			}
+
+			next, err := schedule.NextRun(now)
+			if err != nil {
+				// The expression was validated on save, so this only happens after manual edits
+				log.Printf("[Worker] Disabling Schedule %s: %v", schedule.ID, err)
+				updates["enabled"] = false
+				updates["next_run_at"] = nil
+			} else {
+				updates["next_run_at"] = next
+			}
+
+			if err := tx.Model(&jobs.Schedule{}).Where("id = ?", schedule.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// scheduledSince is where the next incremental export of a schedule starts: the next_cursor of its
+// last completed job, so the changes a failed run missed are picked up by the next one. It is nil,
+// a full export, until one has completed.
+func scheduledSince(tx *gorm.DB, schedule jobs.Schedule) (*time.Time, error) {
+	var last jobs.Job
+	err := tx.Select("next_cursor").
+		Where("idempotency_key LIKE ? AND status = ? AND next_cursor <> ''", schedule.JobKeyPrefix()+"%", jobs.StatusCompleted).
+		Order("finished_at DESC").
+		Take(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return core.ResolveSince(schedule.Resource, nil, last.NextCursor)
+}
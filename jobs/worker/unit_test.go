@@ -0,0 +1,671 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs/core"
+	"github.com/gothinkster/golang-gin-realworld-example-app/testutil"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	return testutil.SetupDB(t, &jobs.Job{}, &jobs.Schedule{})
+}
+
+func createPendingJob(t *testing.T, db *gorm.DB, jobType string) jobs.Job {
+	job := jobs.Job{
+		Type:           jobType,
+		Resource:       "users",
+		Status:         jobs.StatusPending,
+		IdempotencyKey: uuid.NewString(),
+	}
+	require.NoError(t, db.Create(&job).Error)
+	return job
+}
+
+func reloadJob(t *testing.T, db *gorm.DB, id uuid.UUID) jobs.Job {
+	var job jobs.Job
+	require.NoError(t, db.First(&job, "id = ?", id).Error)
+	return job
+}
+
+func TestPool_RunsJobsInParallel(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeExport)
+	createPendingJob(t, db, jobs.TypeExport)
+
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeExport: 2},
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	// Each handler blocks until both jobs are running at the same time
+	var started sync.WaitGroup
+	started.Add(2)
+	bothRunning := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(bothRunning)
+	}()
+
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		started.Done()
+		select {
+		case <-bothRunning:
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	pool.Start()
+	defer pool.Stop()
+
+	select {
+	case <-bothRunning:
+	case <-time.After(2 * time.Second):
+		t.Fatal("jobs were not executed in parallel")
+	}
+}
+
+func TestPool_NeverClaimsJobTwice(t *testing.T) {
+	db := setupTestDB(t)
+
+	const total = 30
+	for i := 0; i < total; i++ {
+		jobType := jobs.TypeImport
+		if i%2 == 0 {
+			jobType = jobs.TypeExport
+		}
+		createPendingJob(t, db, jobType)
+	}
+
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeImport: 3, jobs.TypeExport: 3},
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	var mu sync.Mutex
+	claims := make(map[uuid.UUID]int)
+	var done sync.WaitGroup
+	done.Add(total)
+
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		mu.Lock()
+		claims[job.ID]++
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		done.Done()
+	}
+
+	pool.Start()
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for jobs")
+	}
+	pool.Stop()
+
+	assert.Len(t, claims, total)
+	for id, n := range claims {
+		assert.Equal(t, 1, n, "job %s claimed more than once", id)
+	}
+
+	var pending int64
+	db.Model(&jobs.Job{}).Where("status = ?", jobs.StatusPending).Count(&pending)
+	assert.Zero(t, pending)
+}
+
+func TestPool_TypesDoNotStarveEachOther(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeImport)
+	createPendingJob(t, db, jobs.TypeImport)
+	export := createPendingJob(t, db, jobs.TypeExport)
+
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeImport: 1, jobs.TypeExport: 1},
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	release := make(chan struct{})
+	exportDone := make(chan uuid.UUID, 1)
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		if job.Type == jobs.TypeImport {
+			// A long-running import holds the only import slot
+			<-release
+			return
+		}
+		exportDone <- job.ID
+	}
+
+	pool.Start()
+	defer pool.Stop()
+	defer close(release)
+
+	select {
+	case id := <-exportDone:
+		assert.Equal(t, export.ID, id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("export was starved by a running import")
+	}
+}
+
+func TestClaimNextJob_RecordsLease(t *testing.T) {
+	db := setupTestDB(t)
+	created := createPendingJob(t, db, jobs.TypeImport)
+
+	job, err := claimNextJob(db, jobs.TypeImport, "worker-a")
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, job.ID)
+
+	stored := reloadJob(t, db, job.ID)
+	assert.Equal(t, jobs.StatusProcessing, stored.Status)
+	assert.Equal(t, "worker-a", stored.WorkerID)
+	assert.Equal(t, 1, stored.Attempts)
+	assert.NotNil(t, stored.HeartbeatAt)
+
+	// A second claim finds nothing left to do
+	_, err = claimNextJob(db, jobs.TypeImport, "worker-b")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestReapExpiredLeases(t *testing.T) {
+	db := setupTestDB(t)
+	stale := time.Now().Add(-10 * time.Minute)
+	fresh := time.Now()
+
+	retry := createPendingJob(t, db, jobs.TypeImport)
+	exhausted := createPendingJob(t, db, jobs.TypeImport)
+	alive := createPendingJob(t, db, jobs.TypeImport)
+
+	db.Model(&retry).Updates(map[string]interface{}{"status": jobs.StatusProcessing, "worker_id": "dead", "attempts": 1, "heartbeat_at": stale})
+	db.Model(&exhausted).Updates(map[string]interface{}{"status": jobs.StatusProcessing, "worker_id": "dead", "attempts": 3, "heartbeat_at": stale})
+	db.Model(&alive).Updates(map[string]interface{}{"status": jobs.StatusProcessing, "worker_id": "live", "attempts": 1, "heartbeat_at": fresh})
+
+	requeued, deadLettered, err := reapExpiredLeases(db, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, requeued)
+	assert.EqualValues(t, 1, deadLettered)
+
+	got := reloadJob(t, db, retry.ID)
+	assert.Equal(t, jobs.StatusPending, got.Status)
+	assert.Equal(t, "dead", got.WorkerID, "last worker ID is kept for inspection")
+
+	got = reloadJob(t, db, exhausted.ID)
+	assert.Equal(t, jobs.StatusDeadLetter, got.Status)
+	assert.Contains(t, got.ErrorMessage, "lease expired")
+
+	got = reloadJob(t, db, alive.ID)
+	assert.Equal(t, jobs.StatusProcessing, got.Status)
+}
+
+func TestFinishAbandonedCancellations(t *testing.T) {
+	db := setupTestDB(t)
+	stale := time.Now().Add(-10 * time.Minute)
+
+	abandoned := createPendingJob(t, db, jobs.TypeImport)
+	stopping := createPendingJob(t, db, jobs.TypeImport)
+	db.Model(&abandoned).Updates(map[string]interface{}{"status": jobs.StatusCancelled, "worker_id": "dead", "heartbeat_at": stale})
+	db.Model(&stopping).Updates(map[string]interface{}{"status": jobs.StatusCancelled, "worker_id": "live", "heartbeat_at": time.Now()})
+
+	finished, err := finishAbandonedCancellations(db, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, finished)
+
+	got := reloadJob(t, db, abandoned.ID)
+	assert.Equal(t, jobs.StatusCancelled, got.Status)
+	assert.True(t, got.Update().Finished, "its event stream ends")
+
+	got = reloadJob(t, db, stopping.ID)
+	assert.Nil(t, got.FinishedAt, "a live worker finishes its own job")
+}
+
+func TestSaveOwnedJob_IgnoresLostLease(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeExport)
+
+	job, err := claimNextJob(db, jobs.TypeExport, "worker-a")
+	require.NoError(t, err)
+
+	// Another worker took the job over after the lease expired
+	db.Model(&jobs.Job{}).Where("id = ?", job.ID).Update("worker_id", "worker-b")
+
+	job.Status = jobs.StatusCompleted
+	assert.Error(t, saveOwnedJob(db, job))
+
+	assert.Equal(t, jobs.StatusProcessing, reloadJob(t, db, job.ID).Status)
+}
+
+// cancelRunningJob claims a job and cancels it the way POST /v1/jobs/:id/cancel does, after the
+// worker's last heartbeat check
+func cancelRunningJob(t *testing.T, db *gorm.DB, jobType string) *jobs.Job {
+	createPendingJob(t, db, jobType)
+	job, err := claimNextJob(db, jobType, "worker-a")
+	require.NoError(t, err)
+	require.NoError(t, db.Model(&jobs.Job{}).Where("id = ?", job.ID).
+		Updates(map[string]interface{}{"status": jobs.StatusCancelled, "finished_at": nil}).Error)
+	return job
+}
+
+func TestSaveOwnedJob_KeepsJobCancelledWhileRunning(t *testing.T) {
+	db := setupTestDB(t)
+	job := cancelRunningJob(t, db, jobs.TypeExport)
+
+	// The run completes anyway
+	job.Status = jobs.StatusCompleted
+	job.ProcessedRows = 42
+	require.NoError(t, saveOwnedJob(db, job))
+	assert.Equal(t, jobs.StatusCancelled, job.Status)
+
+	got := reloadJob(t, db, job.ID)
+	assert.Equal(t, jobs.StatusCancelled, got.Status)
+	assert.Equal(t, 42, got.ProcessedRows)
+	assert.NotNil(t, got.FinishedAt)
+}
+
+func TestExecuteJob_KeepsJobCancelledWhenItFails(t *testing.T) {
+	db := setupTestDB(t)
+	job := cancelRunningJob(t, db, jobs.TypeExport)
+
+	// The run fails for good before noticing the cancellation
+	job.Type = "UNKNOWN"
+	executeJob(context.Background(), job)
+
+	got := reloadJob(t, db, job.ID)
+	assert.Equal(t, jobs.StatusCancelled, got.Status)
+	assert.Empty(t, got.ErrorMessage)
+	assert.NotNil(t, got.FinishedAt)
+}
+
+func TestFailJob_NeverRequeuesACancelledJob(t *testing.T) {
+	db := setupTestDB(t)
+	job := cancelRunningJob(t, db, jobs.TypeImport)
+
+	failJob(job, errors.New("connection reset"))
+	require.Equal(t, jobs.StatusPending, job.Status, "a transient failure is retried")
+	require.NoError(t, saveOwnedJob(db, job))
+
+	got := reloadJob(t, db, job.ID)
+	assert.Equal(t, jobs.StatusCancelled, got.Status)
+	assert.Nil(t, got.NextRunAt)
+	assert.NotNil(t, got.FinishedAt)
+
+	_, err := claimNextJob(db, jobs.TypeImport, "worker-b")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+// rowWatcher is the destination of an export that calls check once after the given number of lines
+type rowWatcher struct {
+	lines, after int
+	check        func()
+}
+
+func (w *rowWatcher) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			if w.lines++; w.lines == w.after {
+				w.check()
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func TestExportProgress_SavesProgressToJobRow(t *testing.T) {
+	db := testutil.SetupDB(t, append(testutil.AppModels(), &jobs.Job{})...)
+	orig := jobs.ProgressFlushInterval
+	jobs.ProgressFlushInterval = 0
+	t.Cleanup(func() { jobs.ProgressFlushInterval = orig })
+
+	for i := 0; i < 2500; i++ {
+		require.NoError(t, db.Create(&users.UserModel{Username: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), PasswordHash: "x"}).Error)
+	}
+	createPendingJob(t, db, jobs.TypeExport)
+	job, err := claimNextJob(db, jobs.TypeExport, "worker-a")
+	require.NoError(t, err)
+	job.TotalRows = 2500
+
+	// Partway through, GET /v1/jobs/:id already sees the rows written so far
+	var midway jobs.Job
+	watcher := &rowWatcher{after: 1500, check: func() { midway = reloadJob(t, db, job.ID) }}
+	rows, err := core.StreamExport(context.Background(), "users", core.ExportOptions{Format: "ndjson", OnProgress: exportProgress(job)}, watcher)
+	require.NoError(t, err)
+	require.Equal(t, 2500, rows)
+
+	assert.Equal(t, 1000, midway.ProcessedRows)
+	assert.Equal(t, 2500, midway.TotalRows)
+	assert.Zero(t, job.ProcessedRows, "the job itself is only updated once the export is done")
+}
+
+func TestPool_CancelStopsRunningJob(t *testing.T) {
+	db := setupTestDB(t)
+	created := createPendingJob(t, db, jobs.TypeImport)
+
+	pool := NewPool(PoolConfig{
+		Concurrency:       map[string]int{jobs.TypeImport: 1},
+		PollInterval:      10 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+
+	running := make(chan struct{})
+	causes := make(chan error, 1)
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		close(running)
+		select {
+		case <-ctx.Done():
+			causes <- context.Cause(ctx)
+		case <-time.After(2 * time.Second):
+			causes <- nil
+		}
+	}
+
+	pool.Start()
+	defer pool.Stop()
+
+	<-running
+	// Same update as POST /v1/jobs/:id/cancel
+	db.Model(&jobs.Job{}).Where("id = ?", created.ID).Update("status", jobs.StatusCancelled)
+
+	assert.ErrorIs(t, <-causes, jobs.ErrJobCancelled)
+}
+
+func TestClaimNextJob_WaitsForNextRunAt(t *testing.T) {
+	db := setupTestDB(t)
+	job := createPendingJob(t, db, jobs.TypeImport)
+	db.Model(&job).Update("next_run_at", time.Now().Add(time.Hour))
+
+	_, err := claimNextJob(db, jobs.TypeImport, "worker-a")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	db.Model(&job).Update("next_run_at", time.Now().Add(-time.Second))
+	claimed, err := claimNextJob(db, jobs.TypeImport, "worker-a")
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, claimed.ID)
+}
+
+func TestFailJob_RetryPolicy(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+
+	t.Run("transient error is retried with backoff", func(t *testing.T) {
+		job := &jobs.Job{Attempts: 1, MaxAttempts: 3}
+		failJob(job, transient)
+		assert.Equal(t, jobs.StatusPending, job.Status)
+		require.NotNil(t, job.NextRunAt)
+		assert.WithinDuration(t, time.Now().Add(RetryBaseDelay), *job.NextRunAt, time.Second)
+		assert.Equal(t, transient.Error(), job.ErrorMessage)
+	})
+
+	t.Run("permanent error fails immediately", func(t *testing.T) {
+		job := &jobs.Job{Attempts: 1, MaxAttempts: 3}
+		failJob(job, jobs.Permanent(errors.New("unknown resource: widgets")))
+		assert.Equal(t, jobs.StatusFailed, job.Status)
+		assert.Nil(t, job.NextRunAt)
+	})
+
+	t.Run("last attempt is dead-lettered", func(t *testing.T) {
+		job := &jobs.Job{Attempts: 3, MaxAttempts: 3}
+		failJob(job, transient)
+		assert.Equal(t, jobs.StatusDeadLetter, job.Status)
+	})
+
+	t.Run("wrapped permanent error is still permanent", func(t *testing.T) {
+		job := &jobs.Job{Attempts: 1, MaxAttempts: 3}
+		failJob(job, fmt.Errorf("failed to open stream: %w", jobs.Permanent(errors.New("NoSuchKey"))))
+		assert.Equal(t, jobs.StatusFailed, job.Status)
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, RetryBaseDelay, retryDelay(1))
+	assert.Equal(t, 2*RetryBaseDelay, retryDelay(2))
+	assert.Equal(t, 4*RetryBaseDelay, retryDelay(3))
+	assert.Equal(t, RetryMaxDelay, retryDelay(50))
+}
+
+func TestPool_NotificationWakesIdleWorker(t *testing.T) {
+	db := setupTestDB(t)
+	notifier := jobs.NewMemoryNotifier()
+
+	// The fallback sweep is far away, only the notification can trigger the claim
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeExport: 1},
+		Notifier:     notifier,
+		PollInterval: time.Hour,
+	})
+
+	handled := make(chan uuid.UUID, 1)
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		handled <- job.ID
+	}
+
+	pool.Start()
+	defer pool.Stop()
+
+	// Let the worker finish its initial sweep of the empty queue
+	time.Sleep(50 * time.Millisecond)
+
+	job := createPendingJob(t, db, jobs.TypeExport)
+	require.NoError(t, notifier.Notify(context.Background(), jobs.TypeExport))
+
+	select {
+	case id := <-handled:
+		assert.Equal(t, job.ID, id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification did not wake the worker")
+	}
+}
+
+func TestClaimNextJob_PriorityAndRunAt(t *testing.T) {
+	db := setupTestDB(t)
+
+	backfill := createPendingJob(t, db, jobs.TypeExport)
+	urgent := createPendingJob(t, db, jobs.TypeExport)
+	scheduled := createPendingJob(t, db, jobs.TypeExport)
+	db.Model(&urgent).Update("priority", 10)
+	db.Model(&scheduled).Updates(map[string]interface{}{"priority": 100, "run_at": time.Now().Add(time.Hour)})
+
+	first, err := claimNextJob(db, jobs.TypeExport, "worker-a")
+	require.NoError(t, err)
+	assert.Equal(t, urgent.ID, first.ID, "higher priority jumps the queue")
+
+	second, err := claimNextJob(db, jobs.TypeExport, "worker-a")
+	require.NoError(t, err)
+	assert.Equal(t, backfill.ID, second.ID, "scheduled job is not due yet")
+
+	_, err = claimNextJob(db, jobs.TypeExport, "worker-a")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestEnqueueDueSchedules_OncePerFiring(t *testing.T) {
+	db := setupTestDB(t)
+
+	firing := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	schedule := jobs.Schedule{
+		Cron:      "0 2 * * *",
+		Resource:  "articles",
+		Format:    "csv",
+		Filters:   map[string]string{"author": "jake"},
+		Priority:  3,
+		Enabled:   true,
+		NextRunAt: &firing,
+	}
+	require.NoError(t, db.Create(&schedule).Error)
+
+	now := firing.Add(30 * time.Second)
+	created, err := enqueueDueSchedules(db, now)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	assert.Equal(t, jobs.TypeExport, created[0].Type)
+	assert.Equal(t, 3, created[0].Priority)
+	assert.JSONEq(t, `{"format":"csv","filters":{"author":"jake"}}`, created[0].SourceKey)
+
+	var got jobs.Schedule
+	require.NoError(t, db.First(&got, "id = ?", schedule.ID).Error)
+	require.NotNil(t, got.NextRunAt)
+	assert.Equal(t, firing.Add(24*time.Hour), got.NextRunAt.UTC())
+	require.NotNil(t, got.LastJobID)
+	assert.Equal(t, created[0].ID, *got.LastJobID)
+
+	// A second instance that still saw the old next_run_at must not queue the firing again
+	db.Model(&jobs.Schedule{}).Where("id = ?", schedule.ID).Update("next_run_at", firing)
+	created, err = enqueueDueSchedules(db, now)
+	require.NoError(t, err)
+	assert.Empty(t, created)
+
+	var count int64
+	db.Model(&jobs.Job{}).Count(&count)
+	assert.EqualValues(t, 1, count)
+}
+
+func TestEnqueueDueSchedules_ChainsIncrementalExports(t *testing.T) {
+	db := setupTestDB(t)
+
+	firing := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	schedule := jobs.Schedule{
+		Cron:        "0 2 * * *",
+		Resource:    "articles",
+		Format:      "ndjson",
+		Expand:      []string{"tags"},
+		Fields:      []string{"id", "title", "tagList:tags"},
+		Incremental: true,
+		Enabled:     true,
+		NextRunAt:   &firing,
+	}
+	require.NoError(t, db.Create(&schedule).Error)
+
+	// Nothing completed yet: the first firing exports everything
+	created, err := enqueueDueSchedules(db, firing)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	assert.JSONEq(t, `{"format":"ndjson","filters":null,"expand":["tags"],"fields":["id","title","tagList:tags"]}`, created[0].SourceKey)
+
+	snapshot := firing.Add(time.Minute)
+	cursor := core.NextCursor("articles", snapshot)
+	db.Model(&created[0]).Updates(map[string]interface{}{"status": jobs.StatusCompleted, "finished_at": snapshot, "next_cursor": cursor})
+	// A later firing that failed doesn't move the chain on
+	failed := createPendingJob(t, db, jobs.TypeExport)
+	db.Model(&failed).Updates(map[string]interface{}{"status": jobs.StatusFailed, "finished_at": snapshot.Add(time.Hour),
+		"idempotency_key": schedule.JobKeyPrefix() + "1", "next_cursor": core.NextCursor("articles", snapshot.Add(time.Hour))})
+
+	next := firing.Add(24 * time.Hour)
+	created, err = enqueueDueSchedules(db, next)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	var config jobs.ExportConfig
+	require.NoError(t, json.Unmarshal([]byte(created[0].SourceKey), &config))
+	want, err := core.ResolveSince("articles", nil, cursor)
+	require.NoError(t, err)
+	require.NotNil(t, config.Since)
+	assert.True(t, want.Equal(*config.Since), "starts from the cursor of the last completed firing")
+	assert.Equal(t, []string{"id", "title", "tagList:tags"}, config.Fields)
+}
+
+func TestEnqueueDueSchedules_SkipsDisabledAndFuture(t *testing.T) {
+	db := setupTestDB(t)
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	require.NoError(t, db.Create(&jobs.Schedule{Cron: "* * * * *", Resource: "users", Format: "ndjson", NextRunAt: &past}).Error)
+	require.NoError(t, db.Create(&jobs.Schedule{Cron: "* * * * *", Resource: "users", Format: "ndjson", Enabled: true, NextRunAt: &future}).Error)
+
+	created, err := enqueueDueSchedules(db, now)
+	require.NoError(t, err)
+	assert.Empty(t, created)
+}
+
+func TestPool_ShutdownLetsRunningJobFinish(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeImport)
+
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeImport: 1},
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	running := make(chan struct{})
+	var finished bool
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		close(running)
+		time.Sleep(50 * time.Millisecond)
+		finished = ctx.Err() == nil
+	}
+	pool.Start()
+	<-running
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, pool.Shutdown(ctx))
+	assert.True(t, finished, "job finished without being interrupted")
+
+	// No more claims once the pool is stopped
+	next := createPendingJob(t, db, jobs.TypeImport)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, jobs.StatusPending, reloadJob(t, db, next.ID).Status)
+}
+
+func TestPool_ShutdownInterruptsAfterTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeImport)
+
+	pool := NewPool(PoolConfig{
+		Concurrency:  map[string]int{jobs.TypeImport: 1},
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	running := make(chan struct{})
+	causes := make(chan error, 1)
+	pool.handle = func(ctx context.Context, job *jobs.Job) {
+		close(running)
+		select {
+		case <-ctx.Done():
+			causes <- context.Cause(ctx)
+		case <-time.After(2 * time.Second):
+			causes <- nil
+		}
+	}
+	pool.Start()
+	<-running
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-causes, ErrShutdown)
+}
+
+func TestReleaseJob_ReturnsJobToQueue(t *testing.T) {
+	db := setupTestDB(t)
+	createPendingJob(t, db, jobs.TypeImport)
+
+	job, err := claimNextJob(db, jobs.TypeImport, "worker-a")
+	require.NoError(t, err)
+	job.ProcessedRows = 800
+
+	require.NoError(t, releaseJob(db, job))
+
+	got := reloadJob(t, db, job.ID)
+	assert.Equal(t, jobs.StatusPending, got.Status)
+	assert.Equal(t, 0, got.Attempts, "a shutdown does not use up an attempt")
+	assert.Equal(t, 800, got.ProcessedRows)
+
+	// Once reaped or cancelled the job is no longer ours to release
+	job, err = claimNextJob(db, jobs.TypeImport, "worker-a")
+	require.NoError(t, err)
+	db.Model(&jobs.Job{}).Where("id = ?", job.ID).Update("status", jobs.StatusCancelled)
+	assert.Error(t, releaseJob(db, job))
+}
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+)
+
+// webhooks periodically queues the webhooks of finished jobs and sends the ones that are due.
+// Sending stops between deliveries as soon as the pool is told to stop, so a long batch
+// can't hold Shutdown past its deadline.
+func (p *Pool) webhooks() {
+	defer p.wg.Done()
+
+	ctx, cancel := context.WithCancel(p.jobsCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(p.config.WebhookInterval)
+	defer ticker.Stop()
+
+	client := jobs.NewWebhookClient()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			db := common.GetDB()
+			if _, err := jobs.QueueWebhooks(db, time.Now()); err != nil {
+				log.Printf("[Worker] Could not queue webhooks: %v", err)
+			}
+			if _, err := jobs.DeliverWebhooks(ctx, db, client, time.Now()); err != nil {
+				log.Printf("[Worker] Could not deliver webhooks: %v", err)
+			}
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -21,10 +28,38 @@ func Migrate(db *gorm.DB) {
 	db.AutoMigrate(&articles.TagModel{})
 	db.AutoMigrate(&articles.FavoriteModel{})
 	db.AutoMigrate(&articles.ArticleUserModel{})
+	// Comment UUIDs used to have a plain index, replaced by the unique one of the same name
+	dropNonUniqueIndex(db, &articles.CommentModel{}, "idx_comment_models_uuid")
 	db.AutoMigrate(&articles.CommentModel{})
 
-	// Migrate the Job table
+	// Rows created before the API gave them a UUID can't be exported and imported back without one
+	for _, model := range []interface{}{&users.UserModel{}, &articles.ArticleModel{}, &articles.CommentModel{}} {
+		if err := common.BackfillUUIDs(db, model); err != nil {
+			log.Printf("Failed to backfill UUIDs of %T: %v", model, err)
+		}
+	}
+
+	// Migrate the Job, Schedule and Webhook tables
 	db.AutoMigrate(&jobs.Job{})
+	db.AutoMigrate(&jobs.Schedule{})
+	db.AutoMigrate(&jobs.WebhookSubscription{})
+	db.AutoMigrate(&jobs.WebhookDelivery{})
+}
+
+// dropNonUniqueIndex drops the index of model called name unless it is unique, so AutoMigrate
+// creates it again as a unique one
+func dropNonUniqueIndex(db *gorm.DB, model interface{}, name string) {
+	indexes, err := db.Migrator().GetIndexes(model)
+	if err != nil {
+		return
+	}
+	for _, index := range indexes {
+		if unique, ok := index.Unique(); index.Name() == name && ok && !unique {
+			if err := db.Migrator().DropIndex(model, name); err != nil {
+				log.Printf("Failed to drop index %s: %v", name, err)
+			}
+		}
+	}
 }
 
 func main() {
@@ -42,8 +77,11 @@ func main() {
 		defer sqlDB.Close()
 	}
 
+	// Wake workers on every instance through Postgres LISTEN/NOTIFY
+	jobs.SetNotifier(jobs.NewPostgresNotifier(db, common.DSN()))
+
 	// START THE WORKER HERE
-	worker.StartWorker()
+	pool := worker.StartWorker()
 
 	r := gin.Default()
 
@@ -80,15 +118,51 @@ func main() {
 	// EXPORTS
 	v1Root.POST("/exports", routers.AsyncExport)
 	v1Root.GET("/exports", routers.SyncExport)
-
-	// JOBS
-	v1Root.GET("/exports/:job_id", routers.GetJobStatus)
+	routers.SchedulesRegister(v1Root.Group("/schedules"))
+	routers.WebhooksRegister(v1Root.Group("/webhooks"))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("failed to start server:", err)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("failed to start server:", err)
+		}
+	}()
+
+	// Wait for a deploy (SIGTERM) or Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down...")
+
+	// Stop claiming jobs right away, while the HTTP server winds down: running jobs get a chance
+	// to finish before being re-queued, and no new job is started on an instance that is going away
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), envSeconds("WORKER_DRAIN_SECONDS", 30))
+	defer cancelDrain()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		if err := pool.Shutdown(drainCtx); err != nil {
+			log.Println("Worker pool did not drain in time:", err)
+		}
+	}()
+
+	// Stop accepting requests and let the in-flight ones finish
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), envSeconds("HTTP_SHUTDOWN_SECONDS", 10))
+	defer cancelHTTP()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Println("HTTP server did not shut down cleanly:", err)
+	}
+	<-drained
+	log.Println("Shutdown complete")
+}
+
+func envSeconds(key string, fallback int) time.Duration {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return time.Duration(v) * time.Second
 	}
+	return time.Duration(fallback) * time.Second
 }
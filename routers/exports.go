@@ -1,12 +1,15 @@
 package routers
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"github.com/gothinkster/golang-gin-realworld-example-app/jobs/core"
@@ -15,12 +18,17 @@ import (
 type ExportRequest struct {
 	Resource string            `json:"resource" binding:"required"`
 	Format   string            `json:"format"`
-	Filters  map[string]string `json:"filters"`
-}
-
-type ExportConfig struct {
-	Format  string            `json:"format"`
-	Filters map[string]string `json:"filters"`
+	Filter   string            `json:"filter"`  // Filter expression, e.g. tag IN (go, web) AND created_at >= 2026-01-01
+	Filters  map[string]string `json:"filters"` // Equality filters by field name, ANDed with filter
+	Expand   []string          `json:"expand"`  // tags, author, comments, favorites_count (articles only)
+	Fields   []string          `json:"fields"`  // Fields to export, in order, each renamed with name:alias
+	Since    *time.Time        `json:"since"`   // Incremental export of the rows changed since then
+	Cursor   string            `json:"cursor"`  // Incremental export from the next_cursor of a previous job
+	Priority int               `json:"priority"`
+	RunAt    *time.Time        `json:"run_at"`
+
+	// CallbackURL receives a signed webhook once the job is finished
+	CallbackURL string `json:"callback_url"`
 }
 
 // AsyncExport (POST /v1/exports)
@@ -31,68 +39,93 @@ func AsyncExport(c *gin.Context) {
 		return
 	}
 
-	if req.Resource != "users" && req.Resource != "articles" && req.Resource != "comments" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid resource"})
+	format, err := jobs.ValidateExport(req.Resource, req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if req.Format == "" {
-		req.Format = "ndjson"
+	expand, err := jobs.ValidateExpand(req.Resource, req.Expand)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-
-	if req.Format != "ndjson" && req.Format != "csv" && req.Format != "json" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Use: ndjson, csv, or json"})
+	if err := core.ValidateFields(req.Resource, format, expand, req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	jobUUID := uuid.New()
+	if _, err := core.ParseFilter(req.Resource, req.Filter, req.Filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	since, err := core.ResolveSince(req.Resource, req.Since, req.Cursor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := jobs.ValidateCallbackURL(req.CallbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
 	// Pack configuration into JSON for the SourceKey
-	config := ExportConfig{
-		Format:  req.Format,
+	job := jobs.NewExportJob(req.Resource, jobs.ExportConfig{
+		Format:  format,
+		Filter:  req.Filter,
 		Filters: req.Filters,
-	}
-	configBytes, _ := json.Marshal(config)
-
-	job := jobs.Job{
-		ID:             jobUUID,
-		Type:           jobs.TypeExport,
-		Resource:       req.Resource,
-		Status:         jobs.StatusPending,
-		SourceKey:      string(configBytes),
-		IdempotencyKey: jobUUID.String(),
-	}
+		Expand:  expand,
+		Fields:  req.Fields,
+		Since:   since,
+	}, "")
+	job.Priority = req.Priority
+	job.RunAt = req.RunAt
+	job.CallbackURL = req.CallbackURL
 
 	db := common.GetDB()
 	if err := db.Create(&job).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
 		return
 	}
+	jobs.NotifyQueued(c.Request.Context(), job)
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"job_id":  job.ID.String(),
-		"status":  "PENDING",
-		"message": "Export job started",
+		"job_id":   job.ID.String(),
+		"status":   "PENDING",
+		"message":  "Export job started",
+		"priority": job.Priority,
+		"run_at":   job.RunAt,
 	})
 }
 
+// A sync export holds a snapshot transaction, and so a database connection, for as long as the
+// client takes to read it. They are capped in number and duration; bigger exports belong to
+// POST /v1/exports. Set from SYNC_EXPORT_CONCURRENCY (default 4) and SYNC_EXPORT_TIMEOUT_SECONDS
+// (default 300).
+var (
+	SyncExportLimit   = envInt("SYNC_EXPORT_CONCURRENCY", 4)
+	SyncExportTimeout = time.Duration(envInt("SYNC_EXPORT_TIMEOUT_SECONDS", 300)) * time.Second
+	// SyncExportIdleTimeout is how long the snapshot may wait on a client that stopped reading
+	SyncExportIdleTimeout = 30 * time.Second
+
+	syncExportsRunning atomic.Int32
+)
+
+// exportQueryOptions are the query parameters of GET /v1/exports that aren't field filters
+var exportQueryOptions = map[string]bool{"resource": true, "format": true, "expand": true, "fields": true, "filter": true}
+
 // SyncExport (GET /v1/exports)
 func SyncExport(c *gin.Context) {
 	resource := c.Query("resource")
 	format := c.Query("format")
 
-	// Collect filters from query params
+	// Collect filters from query params: any other parameter naming a field the resource can be
+	// filtered on is an equality filter on it. The rest, such as cache busters, are ignored.
 	filters := make(map[string]string)
-	if author := c.Query("author"); author != "" {
-		filters["author"] = author
-	}
-	if tag := c.Query("tag"); tag != "" {
-		filters["tag"] = tag
-	}
-	if username := c.Query("username"); username != "" {
-		filters["username"] = username
-	}
-	if article := c.Query("article"); article != "" {
-		filters["article"] = article
+	for key := range c.Request.URL.Query() {
+		if !exportQueryOptions[key] && core.IsFilterField(resource, key) {
+			filters[key] = c.Query(key)
+		}
 	}
 
 	if resource != "users" && resource != "articles" && resource != "comments" {
@@ -102,6 +135,23 @@ func SyncExport(c *gin.Context) {
 	if format == "" {
 		format = "ndjson"
 	}
+	// expand=tags,author or expand=tags&expand=author
+	expand, err := jobs.ValidateExpand(resource, c.QueryArray("expand"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// fields=id,username:name picks, orders and renames the fields
+	fields := c.QueryArray("fields")
+	if err := core.ValidateFields(resource, format, expand, fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter := c.Query("filter")
+	if _, err := core.ParseFilter(resource, filter, filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	contentType := "application/x-ndjson"
 	if format == "csv" {
@@ -111,12 +161,52 @@ func SyncExport(c *gin.Context) {
 		contentType = "application/json"
 	}
 
+	if syncExportsRunning.Add(1) > int32(SyncExportLimit) {
+		syncExportsRunning.Add(-1)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many exports streaming, retry later or use POST /v1/exports"})
+		return
+	}
+	defer syncExportsRunning.Add(-1)
+
+	// Past the deadline the stream stops at its next page, and a client that stopped reading
+	// gets its writes failed rather than holding the snapshot open
+	deadline := time.Now().Add(SyncExportTimeout)
+	ctx, cancel := context.WithDeadline(c.Request.Context(), deadline)
+	defer cancel()
+	http.NewResponseController(c.Writer).SetWriteDeadline(deadline)
+
+	// The stream reads one snapshot from its first page to its last
+	snapshot, _, err := core.BeginSnapshot(common.GetDB())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		return
+	}
+	defer snapshot.Rollback()
+	if err := core.LimitSnapshot(snapshot, SyncExportIdleTimeout, SyncExportTimeout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		return
+	}
+
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", resource, format))
 	c.Header("Content-Type", contentType)
 	c.Header("Transfer-Encoding", "chunked")
 
-	_, err := core.StreamExport(resource, format, filters, c.Writer)
+	_, err = core.StreamExport(ctx, resource, core.ExportOptions{
+		Format:  format,
+		Filter:  filter,
+		Filters: filters,
+		Expand:  expand,
+		Fields:  fields,
+		DB:      snapshot,
+	}, c.Writer)
 	if err != nil {
 		fmt.Printf("Stream error: %v\n", err)
 	}
 }
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
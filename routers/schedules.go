@@ -0,0 +1,192 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs/core"
+	"gorm.io/gorm"
+)
+
+// SchedulesRegister mounts the recurring export schedules under /v1/schedules
+func SchedulesRegister(router *gin.RouterGroup) {
+	router.POST("", CreateSchedule)
+	router.GET("", ListSchedules)
+	router.GET("/:id", GetSchedule)
+	router.PUT("/:id", UpdateSchedule)
+	router.DELETE("/:id", DeleteSchedule)
+}
+
+type ScheduleRequest struct {
+	Name     string            `json:"name"`
+	Cron     string            `json:"cron" binding:"required"`
+	Resource string            `json:"resource" binding:"required"`
+	Format   string            `json:"format"`
+	Filter   string            `json:"filter"`
+	Filters  map[string]string `json:"filters"`
+	Expand   []string          `json:"expand"`
+	Fields   []string          `json:"fields"`
+	Priority int               `json:"priority"`
+	Enabled  *bool             `json:"enabled"` // Defaults to true
+
+	// Incremental firings export the changes since the last completed one
+	Incremental bool `json:"incremental"`
+}
+
+// bind validates the request and copies it onto schedule, recomputing the next run
+func (req ScheduleRequest) bind(schedule *jobs.Schedule) error {
+	format, err := jobs.ValidateExport(req.Resource, req.Format)
+	if err != nil {
+		return err
+	}
+	if _, err := jobs.ParseCron(req.Cron); err != nil {
+		return err
+	}
+	expand, err := jobs.ValidateExpand(req.Resource, req.Expand)
+	if err != nil {
+		return err
+	}
+	if err := core.ValidateFields(req.Resource, format, expand, req.Fields); err != nil {
+		return err
+	}
+	if _, err := core.ParseFilter(req.Resource, req.Filter, req.Filters); err != nil {
+		return err
+	}
+	if req.Incremental && !core.Incremental(req.Resource) {
+		return fmt.Errorf("incremental exports are only supported for articles and comments")
+	}
+
+	schedule.Name = req.Name
+	schedule.Cron = req.Cron
+	schedule.Resource = req.Resource
+	schedule.Format = format
+	schedule.Filter = req.Filter
+	schedule.Filters = req.Filters
+	schedule.Expand = expand
+	schedule.Fields = req.Fields
+	schedule.Incremental = req.Incremental
+	schedule.Priority = req.Priority
+	schedule.Enabled = req.Enabled == nil || *req.Enabled
+
+	schedule.NextRunAt = nil
+	if schedule.Enabled {
+		next, err := schedule.NextRun(time.Now())
+		if err != nil {
+			return err
+		}
+		schedule.NextRunAt = &next
+	}
+	return nil
+}
+
+// CreateSchedule (POST /v1/schedules)
+func CreateSchedule(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var schedule jobs.Schedule
+	if err := req.bind(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := common.GetDB().Create(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create schedule"})
+		return
+	}
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// ListSchedules (GET /v1/schedules)
+func ListSchedules(c *gin.Context) {
+	var schedules []jobs.Schedule
+	if err := common.GetDB().Order("created_at ASC").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list schedules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules, "count": len(schedules)})
+}
+
+// GetSchedule (GET /v1/schedules/:id)
+func GetSchedule(c *gin.Context) {
+	schedule, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// UpdateSchedule (PUT /v1/schedules/:id) replaces the schedule definition.
+// Run history is kept, the next run is recomputed from the new expression.
+func UpdateSchedule(c *gin.Context) {
+	schedule, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.bind(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := common.GetDB().Model(&schedule).Select("*").Updates(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update schedule"})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule (DELETE /v1/schedules/:id). Jobs it already queued are not affected.
+func DeleteSchedule(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return
+	}
+
+	result := common.GetDB().Delete(&jobs.Schedule{}, "id = ?", id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted"})
+}
+
+// findSchedule loads the schedule named by the :id param, writing the error response if it can't
+func findSchedule(c *gin.Context) (jobs.Schedule, bool) {
+	var schedule jobs.Schedule
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return schedule, false
+	}
+
+	if err := common.GetDB().First(&schedule, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load schedule"})
+		}
+		return schedule, false
+	}
+	return schedule, true
+}
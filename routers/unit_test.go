@@ -0,0 +1,174 @@
+package routers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/testutil"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/v1")
+	v1.GET("/exports", SyncExport)
+	SchedulesRegister(v1.Group("/schedules"))
+	return r
+}
+
+func TestSyncExport_CapsConcurrentStreams(t *testing.T) {
+	router := setupTestRouter()
+
+	originalLimit := SyncExportLimit
+	SyncExportLimit = 1
+	t.Cleanup(func() { SyncExportLimit = originalLimit })
+	syncExportsRunning.Add(1) // One stream already running
+	defer syncExportsRunning.Add(-1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/exports?resource=users", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "POST /v1/exports")
+}
+
+func TestSyncExport_StreamsAndReleasesItsSlot(t *testing.T) {
+	db := testutil.SetupDB(t, testutil.AppModels()...)
+	router := setupTestRouter()
+	require.NoError(t, db.Create(&users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1"}).Error)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/exports?resource=users&fields=id,username", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{\"id\":\"user-1\",\"username\":\"annie\"}\n", w.Body.String())
+	assert.Zero(t, syncExportsRunning.Load())
+}
+
+func TestSyncExport_IgnoresParametersThatAreNotFields(t *testing.T) {
+	db := testutil.SetupDB(t, testutil.AppModels()...)
+	router := setupTestRouter()
+	require.NoError(t, db.Create(&users.UserModel{Username: "annie", Email: "ann@example.com", PasswordHash: "x", UUID: "user-1"}).Error)
+	require.NoError(t, db.Create(&users.UserModel{Username: "bobby", Email: "bob@example.com", PasswordHash: "x", UUID: "user-2"}).Error)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/exports?resource=users&fields=id&username=annie&_=1760000000&utm_source=newsletter", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "{\"id\":\"user-1\"}\n", w.Body.String(), "filters on username only")
+}
+
+func serve(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestSchedules_CRUD(t *testing.T) {
+	db := testutil.SetupDB(t, &jobs.Schedule{})
+	router := setupTestRouter()
+
+	w := serve(router, "POST", "/v1/schedules", gin.H{
+		"name":        "nightly-articles",
+		"cron":        "0 2 * * *",
+		"resource":    "articles",
+		"format":      "csv",
+		"filter":      "tag = go",
+		"expand":      []string{"tags,author"},
+		"fields":      []string{"id", "title", "author_username:author"},
+		"incremental": true,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created jobs.Schedule
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, []string{"tags", "author"}, created.Expand)
+	assert.True(t, created.Incremental)
+	require.NotNil(t, created.NextRunAt)
+
+	// The whole export configuration is stored, not only the filters
+	var stored jobs.Schedule
+	require.NoError(t, db.First(&stored, "id = ?", created.ID).Error)
+	assert.Equal(t, jobs.ExportConfig{
+		Format: "csv",
+		Filter: "tag = go",
+		Expand: []string{"tags", "author"},
+		Fields: []string{"id", "title", "author_username:author"},
+	}, stored.ExportConfig(nil))
+	assert.True(t, stored.Incremental)
+
+	w = serve(router, "GET", "/v1/schedules/"+created.ID.String(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"incremental":true`)
+
+	w = serve(router, "GET", "/v1/schedules", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+
+	// PUT replaces the definition; a paused schedule has no next run
+	w = serve(router, "PUT", "/v1/schedules/"+created.ID.String(), gin.H{"cron": "@hourly", "resource": "users", "enabled": false})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	stored = jobs.Schedule{}
+	require.NoError(t, db.First(&stored, "id = ?", created.ID).Error)
+	assert.Equal(t, "users", stored.Resource)
+	assert.Equal(t, "ndjson", stored.Format)
+	assert.Empty(t, stored.Expand)
+	assert.Empty(t, stored.Fields)
+	assert.False(t, stored.Incremental)
+	assert.False(t, stored.Enabled)
+	assert.Nil(t, stored.NextRunAt)
+
+	w = serve(router, "DELETE", "/v1/schedules/"+created.ID.String(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(router, "GET", "/v1/schedules/"+created.ID.String(), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(router, "DELETE", "/v1/schedules/"+created.ID.String(), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(router, "GET", "/v1/schedules/not-a-uuid", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateSchedule_RejectsBadDefinitions(t *testing.T) {
+	testutil.SetupDB(t, &jobs.Schedule{})
+	router := setupTestRouter()
+
+	tests := []struct {
+		name string
+		body gin.H
+		want string
+	}{
+		{"missing cron", gin.H{"resource": "users"}, "Cron"},
+		{"bad cron", gin.H{"cron": "every night", "resource": "users"}, "invalid cron expression"},
+		{"bad resource", gin.H{"cron": "@daily", "resource": "tags"}, "resource"},
+		{"bad expand", gin.H{"cron": "@daily", "resource": "users", "expand": []string{"tags"}}, "expand is only supported for articles"},
+		{"bad field", gin.H{"cron": "@daily", "resource": "users", "fields": []string{"password"}}, "password"},
+		{"bad filter", gin.H{"cron": "@daily", "resource": "articles", "filter": "tag IN (go"}, "filter"},
+		{"incremental users", gin.H{"cron": "@daily", "resource": "users", "incremental": true}, "incremental exports are only supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, "POST", "/v1/schedules", tt.body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), tt.want)
+		})
+	}
+
+	w := serve(router, "GET", "/v1/schedules", nil)
+	assert.Contains(t, w.Body.String(), `"count":0`)
+}
@@ -0,0 +1,132 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"gorm.io/gorm"
+)
+
+// WebhooksRegister mounts the global webhook subscriptions under /v1/webhooks
+func WebhooksRegister(router *gin.RouterGroup) {
+	router.POST("", CreateWebhook)
+	router.GET("", ListWebhooks)
+	router.GET("/:id", GetWebhook)
+	router.DELETE("/:id", DeleteWebhook)
+}
+
+type WebhookRequest struct {
+	URL      string   `json:"url" binding:"required"`
+	Secret   string   `json:"secret"`   // Generated when empty
+	Statuses []string `json:"statuses"` // COMPLETED, FAILED, CANCELLED, DEAD_LETTER; all of them when empty
+	JobType  string   `json:"job_type"` // IMPORT or EXPORT; both when empty
+}
+
+func (req WebhookRequest) validate() error {
+	if err := jobs.ValidateWebhookURL(req.URL); err != nil {
+		return fmt.Errorf("url %v", err)
+	}
+	for _, status := range req.Statuses {
+		if !jobs.IsFinal(status) {
+			return fmt.Errorf("statuses must be final job statuses: COMPLETED, FAILED, CANCELLED, DEAD_LETTER")
+		}
+	}
+	if req.JobType != "" && req.JobType != jobs.TypeImport && req.JobType != jobs.TypeExport {
+		return fmt.Errorf("job_type must be IMPORT or EXPORT")
+	}
+	return nil
+}
+
+// CreateWebhook (POST /v1/webhooks)
+// The signing secret is only ever returned here.
+func CreateWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.JobType = strings.ToUpper(req.JobType)
+	for i := range req.Statuses {
+		req.Statuses[i] = strings.ToUpper(req.Statuses[i])
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := jobs.WebhookSubscription{
+		URL:      req.URL,
+		Secret:   req.Secret,
+		Statuses: req.Statuses,
+		JobType:  req.JobType,
+	}
+	if err := common.GetDB().Create(&sub).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         sub.ID,
+		"url":        sub.URL,
+		"secret":     sub.Secret,
+		"statuses":   sub.Statuses,
+		"job_type":   sub.JobType,
+		"created_at": sub.CreatedAt,
+	})
+}
+
+// ListWebhooks (GET /v1/webhooks)
+func ListWebhooks(c *gin.Context) {
+	var subs []jobs.WebhookSubscription
+	if err := common.GetDB().Order("created_at ASC").Find(&subs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": subs, "count": len(subs)})
+}
+
+// GetWebhook (GET /v1/webhooks/:id)
+func GetWebhook(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	var sub jobs.WebhookSubscription
+	if err := common.GetDB().First(&sub, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+// DeleteWebhook (DELETE /v1/webhooks/:id). Deliveries still pending for it are dropped.
+func DeleteWebhook(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	result := common.GetDB().Delete(&jobs.WebhookSubscription{}, "id = ?", id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
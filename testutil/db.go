@@ -0,0 +1,50 @@
+// Package testutil holds the fixtures shared by the tests of several packages.
+package testutil
+
+import (
+	"testing"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// SetupDB points common.DB at a fresh in-memory SQLite database with models migrated,
+// and restores the previous one when the test ends.
+// A single connection keeps every goroutine on the same in-memory database.
+func SetupDB(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	require.NoError(t, db.AutoMigrate(models...))
+
+	originalDB := common.DB
+	common.DB = db
+	t.Cleanup(func() {
+		common.DB = originalDB
+		sqlDB.Close()
+	})
+	return db
+}
+
+// AppModels are the RealWorld API's own tables, the ones imports write to and exports read from
+func AppModels() []interface{} {
+	return []interface{}{
+		&users.UserModel{},
+		&users.FollowModel{},
+		&articles.ArticleModel{},
+		&articles.TagModel{},
+		&articles.CommentModel{},
+		&articles.FavoriteModel{},
+		&articles.ArticleUserModel{},
+	}
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"errors"
 
+	"github.com/google/uuid"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -42,6 +43,14 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// BeforeCreate gives every new user the UUID exports and imports refer to it by
+func (u *UserModel) BeforeCreate(tx *gorm.DB) error {
+	if u.UUID == "" {
+		u.UUID = uuid.NewString()
+	}
+	return nil
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
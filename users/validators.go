@@ -2,6 +2,7 @@ package users
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 )
 
@@ -60,6 +61,13 @@ func NewUserModelValidatorFillWith(userModel UserModel) UserModelValidator {
 	return userModelValidator
 }
 
+// ValidateUserModel checks a user that doesn't come from a request, e.g. an imported one, against the
+// same rules as UserModelValidator
+func ValidateUserModel(userModel UserModel) error {
+	userModelValidator := NewUserModelValidatorFillWith(userModel)
+	return binding.Validator.ValidateStruct(&userModelValidator)
+}
+
 type LoginValidator struct {
 	User struct {
 		Email    string `form:"email" json:"email" binding:"required,email"`